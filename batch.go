@@ -0,0 +1,99 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// batchConcurrency is the maximum number of hosts resolved
+// at the same time by ResolveBatch
+const batchConcurrency = 10
+
+// RecordResult is the result of resolving a single host's record
+type RecordResult struct {
+	Record Record
+	Err    error
+}
+
+// ResolveBatch concurrently resolves the records of the given hosts and
+// returns the result of each host. Hosts that aren't resolved before
+// the context is done get the context's error.
+func ResolveBatch(ctx context.Context, hosts []string, c Config) map[string]RecordResult {
+	results := make(map[string]RecordResult, len(hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	slots := make(chan struct{}, batchConcurrency)
+	for _, host := range hosts {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			results[host] = RecordResult{Err: ctx.Err()}
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			req := (&http.Request{
+				Method: "GET",
+				Host:   host,
+				URL:    &url.URL{Scheme: "https", Host: host, Path: "/"},
+				Header: http.Header{},
+			}).WithContext(ctx)
+
+			rec, err := GetRecord(host, c, discardWriter{http.Header{}}, req)
+
+			mu.Lock()
+			results[host] = RecordResult{Record: rec, Err: err}
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Warmup resolves the records of the hosts in Config.WarmupHosts
+// and logs the hosts that couldn't be resolved. It's meant to be
+// called on startup to reduce the first requests' latency, which
+// needs CacheEnable to keep the resolved records around.
+func Warmup(c Config) {
+	if len(c.WarmupHosts) == 0 {
+		return
+	}
+	for host, res := range ResolveBatch(context.Background(), c.WarmupHosts, c) {
+		if res.Err != nil {
+			logger.Printf("[txtdirect]: Couldn't warm up %s: %s", host, res.Err.Error())
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter that drops everything written
+// to it. It's used to resolve records outside of a request.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
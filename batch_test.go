@@ -0,0 +1,107 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResolveBatch(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host", "path"},
+	}
+	hosts := []string{
+		"host.host.example.com",
+		"path.path.example.com",
+		"missing.example.com",
+	}
+
+	results := ResolveBatch(context.Background(), hosts, c)
+	if len(results) != len(hosts) {
+		t.Fatalf("Expected %d results, got %d", len(hosts), len(results))
+	}
+
+	if res := results["host.host.example.com"]; res.Err != nil || res.Record.To != "https://plain.host.test" {
+		t.Errorf("Expected host.host.example.com to point to https://plain.host.test, got %+v", res)
+	}
+	if res := results["path.path.example.com"]; res.Err != nil || res.Record.Type != "path" {
+		t.Errorf("Expected path.path.example.com to be a path record, got %+v", res)
+	}
+	if res := results["missing.example.com"]; res.Err == nil {
+		t.Errorf("Expected an error for missing.example.com, got %+v", res.Record)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for host, res := range ResolveBatch(ctx, hosts, c) {
+		if res.Err == nil {
+			t.Errorf("Expected an error for %s with a canceled context", host)
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	cache.reset()
+	t.Cleanup(cache.reset)
+
+	var mu sync.Mutex
+	queried := map[string]bool{}
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		queried[r.Question[0].Name] = true
+		mu.Unlock()
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://warm.test"))
+	})
+
+	c := Config{
+		Resolver:    addr,
+		Enable:      []string{"host"},
+		WarmupHosts: []string{"a.example.com", "b.example.com"},
+		CacheEnable: true,
+	}
+	Warmup(c)
+
+	mu.Lock()
+	for _, host := range c.WarmupHosts {
+		if !queried["_redirect."+host+"."] {
+			t.Errorf("Expected %s to be resolved on warmup", host)
+		}
+	}
+	queried = map[string]bool{}
+	mu.Unlock()
+
+	// The warmed up hosts are served from the cache
+	for _, host := range c.WarmupHosts {
+		req := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != "https://warm.test" {
+			t.Errorf("Expected %s to redirect to https://warm.test, got %s", host, location)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queried) != 0 {
+		t.Errorf("Expected the warmed up hosts to be served from the cache, got queries %v", queried)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// defaultCacheMaxEntries is used when CacheMaxEntries isn't set
+const defaultCacheMaxEntries = 1024
+
+// staleTTL is the TTL of the expired records served by StaleOnError,
+// as recommended by RFC 8767
+const staleTTL = 30
+
+// now is overridden in tests to simulate the TTL expiry
+var now = time.Now
+
+// cache keeps the TXT records of the recently queried zones
+var cache = txtCache{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+// txtCache is an LRU cache of TXT records keyed by the absolute zone.
+// Expired entries are kept until they're evicted or refreshed.
+type txtCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	zone    string
+	res     txtResult
+	expires time.Time
+}
+
+// get returns the cached TXT records of the given zone with their
+// remaining TTL if they exist and their TTL hasn't elapsed yet
+func (tc *txtCache) get(zone string) (txtResult, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	el, ok := tc.entries[zone]
+	if !ok {
+		return txtResult{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	remaining := entry.expires.Sub(now())
+	if remaining <= 0 {
+		return txtResult{}, false
+	}
+	tc.order.MoveToFront(el)
+
+	// Round the remaining TTL up, so it doesn't reach zero before expiry
+	ttl := uint32((remaining + time.Second - 1) / time.Second)
+	return txtResult{Txts: entry.res.Txts, TTL: ttl}, true
+}
+
+// getStale returns the cached TXT records of the given zone even if
+// their TTL has elapsed. The records are returned with staleTTL.
+func (tc *txtCache) getStale(zone string) (txtResult, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	el, ok := tc.entries[zone]
+	if !ok {
+		return txtResult{}, false
+	}
+	tc.order.MoveToFront(el)
+	return txtResult{Txts: el.Value.(*cacheEntry).res.Txts, TTL: staleTTL}, true
+}
+
+// set caches the TXT records of the given zone for their TTL and evicts
+// the least recently used entries to keep at most max entries
+func (tc *txtCache) set(zone string, res txtResult, max int) {
+	if max <= 0 {
+		max = defaultCacheMaxEntries
+	}
+	expires := now().Add(time.Duration(res.TTL) * time.Second)
+
+	tc.Lock()
+	defer tc.Unlock()
+
+	if el, ok := tc.entries[zone]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.res, entry.expires = res, expires
+		tc.order.MoveToFront(el)
+	} else {
+		tc.entries[zone] = tc.order.PushFront(&cacheEntry{zone: zone, res: res, expires: expires})
+	}
+
+	for tc.order.Len() > max {
+		oldest := tc.order.Back()
+		tc.order.Remove(oldest)
+		delete(tc.entries, oldest.Value.(*cacheEntry).zone)
+	}
+}
+
+// reset removes all of the cached entries
+func (tc *txtCache) reset() {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.entries = make(map[string]*list.Element)
+	tc.order.Init()
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"container/list"
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_queryCache(t *testing.T) {
+	cache.reset()
+	t.Cleanup(cache.reset)
+
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	var mu sync.Mutex
+	var queries int
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		queries++
+		mu.Unlock()
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://cached.test"))
+	})
+
+	c := Config{
+		Resolver:    addr,
+		CacheEnable: true,
+	}
+	for i := 0; i < 2; i++ {
+		txts, err := query("cached.example.com", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if txts[0] != "v=txtv0;to=https://cached.test" {
+			t.Errorf("Unexpected TXT record: %s", txts[0])
+		}
+	}
+	if queries != 1 {
+		t.Errorf("Expected 1 query within the TTL, got %d", queries)
+	}
+
+	// txtReply answers with a 60 seconds TTL
+	current = current.Add(61 * time.Second)
+	if _, err := query("cached.example.com", context.Background(), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if queries != 2 {
+		t.Errorf("Expected the expired record to be queried again, got %d queries", queries)
+	}
+}
+
+func TestRedirectStaleOnError(t *testing.T) {
+	tests := []struct {
+		staleOnError bool
+		location     string
+	}{
+		{
+			staleOnError: true,
+			location:     "https://stale.test",
+		},
+		{
+			staleOnError: false,
+			location:     "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		cache.reset()
+		t.Cleanup(cache.reset)
+
+		current := time.Now()
+		now = func() time.Time { return current }
+		t.Cleanup(func() { now = time.Now })
+
+		var mu sync.Mutex
+		down := false
+		addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+			mu.Lock()
+			defer mu.Unlock()
+			if down {
+				m := new(dns.Msg)
+				m.SetRcode(r, dns.RcodeServerFailure)
+				w.WriteMsg(m)
+				return
+			}
+			w.WriteMsg(txtReply(r, "v=txtv0;to=https://stale.test;code=302"))
+		})
+
+		c := Config{
+			Resolver:     addr,
+			Enable:       []string{"host"},
+			Redirect:     "https://fallback.test",
+			CacheEnable:  true,
+			StaleOnError: test.staleOnError,
+			QueryRetries: -1,
+		}
+		req := httptest.NewRequest("GET", "https://stale.example.com/", nil)
+		if err := Redirect(httptest.NewRecorder(), req, c); err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+
+		// The resolver goes down after the record's 60 seconds TTL
+		mu.Lock()
+		down = true
+		mu.Unlock()
+		current = current.Add(61 * time.Second)
+
+		req = httptest.NewRequest("GET", "https://stale.example.com/", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func Test_txtCacheEviction(t *testing.T) {
+	tc := txtCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	tc.set("a.", txtResult{Txts: []string{"a"}, TTL: 60}, 2)
+	tc.set("b.", txtResult{Txts: []string{"b"}, TTL: 60}, 2)
+	// Use a so b becomes the least recently used entry
+	tc.get("a.")
+	tc.set("c.", txtResult{Txts: []string{"c"}, TTL: 60}, 2)
+
+	if _, ok := tc.get("b."); ok {
+		t.Errorf("Expected b. to be evicted")
+	}
+	for _, zone := range []string{"a.", "c."} {
+		if _, ok := tc.get(zone); !ok {
+			t.Errorf("Expected %s to be cached", zone)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// recordChain keeps the zones and types of the records visited while
+// resolving a request in the order they were visited
+type recordChain struct {
+	mu   sync.Mutex
+	hops []string
+}
+
+// String returns the visited records in the X-TXTDirect-Chain header format
+func (rc *recordChain) String() string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return strings.Join(rc.hops, ", ")
+}
+
+// addRecordChain adds a fresh recordChain instance to the request's
+// context with "recordChain" key
+func addRecordChain(r *http.Request) (*http.Request, *recordChain) {
+	rc := &recordChain{}
+	return r.WithContext(context.WithValue(r.Context(), "recordChain", rc)), rc
+}
+
+// trackRecord adds the given zone and the record's type to the recordChain
+// instance in the context. It does nothing if the chain isn't tracked.
+func trackRecord(ctx context.Context, zone string, rec Record) {
+	rc, ok := ctx.Value("recordChain").(*recordChain)
+	if !ok {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.hops = append(rc.hops, strings.TrimSuffix(absoluteZone(zone), ".")+";type="+rec.Type)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"go.txtdirect.org/txtdirect"
+)
+
+// txtdirect-lint validates the TXT records read from stdin, one per line.
+// Empty lines and lines starting with "#" are skipped. It exits with a
+// non-zero status if any of the records is invalid.
+func main() {
+	var types string
+	var schema bool
+
+	flag.StringVar(&types, "types", "host,path,gometa", "Enable type. Separated using commas like \"host,path,gometa\"")
+	flag.BoolVar(&schema, "schema", false, "Also validate the records against the stricter schema")
+	flag.Parse()
+
+	config := txtdirect.Config{
+		Enable:         strings.Split(types, ","),
+		SchemaValidate: schema,
+	}
+
+	invalid := 0
+	scanner := bufio.NewScanner(os.Stdin)
+	for n := 1; scanner.Scan(); n++ {
+		record := strings.TrimSpace(scanner.Text())
+		if record == "" || strings.HasPrefix(record, "#") {
+			continue
+		}
+
+		err := txtdirect.ValidateRecord(record, config)
+		if err == nil {
+			continue
+		}
+		invalid++
+
+		errs, ok := err.(txtdirect.ValidationErrors)
+		if !ok {
+			errs = txtdirect.ValidationErrors{err}
+		}
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "line %d: %s\n", n, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("[txtdirect-lint]: Couldn't read the records: %s", err.Error())
+	}
+
+	if invalid != 0 {
+		fmt.Fprintf(os.Stderr, "%d invalid record(s)\n", invalid)
+		os.Exit(1)
+	}
+}
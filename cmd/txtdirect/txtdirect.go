@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 
@@ -55,6 +56,50 @@ func (TXTDirect) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// instances counts the provisioned handlers. The health checks and the
+// log output are global, and on a config reload Caddy cleans up the old
+// handlers after the new ones are provisioned, so they're only stopped
+// when the last handler is cleaned up.
+var instances struct {
+	sync.Mutex
+	count int
+}
+
+// Provision implements caddy.Provisioner.
+func (t *TXTDirect) Provision(ctx caddy.Context) error {
+	// Caddy cleans up the handlers that fail to provision too
+	instances.Lock()
+	instances.count++
+	instances.Unlock()
+
+	// The JSON configs without any txtdirect options leave the config unset
+	if t.Config == nil {
+		t.Config = &txtdirect.Config{}
+	}
+	if err := t.Config.Validate(); err != nil {
+		return fmt.Errorf("[txtdirect]: Invalid config: %s", err.Error())
+	}
+	// Set here so the JSON configs get their LogOutput too, Cleanup
+	// closes the log file
+	if err := txtdirect.SetLogOutput(t.Config.LogOutput); err != nil {
+		return fmt.Errorf("[txtdirect]: Couldn't set the log output: %s", err.Error())
+	}
+	go txtdirect.Warmup(*t.Config)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (t *TXTDirect) Cleanup() error {
+	instances.Lock()
+	defer instances.Unlock()
+	instances.count--
+	if instances.count > 0 {
+		return nil
+	}
+	txtdirect.StopHealthChecks()
+	return txtdirect.CloseLogOutput()
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (t TXTDirect) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	r.URL.Host = strings.ToLower(r.URL.Host)
@@ -65,13 +110,6 @@ func (t TXTDirect) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyh
 		return err
 	}
 
-	if w.Header().Get("Status-Code") == "301" || w.Header().Get("Status-Code") == "302" {
-		// Set Cache-Control header on permanent redirects
-		if w.Header().Get("Status-Code") == "301" {
-			w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", txtdirect.Status301CacheAge))
-		}
-	}
-
 	return nil
 }
 
@@ -94,6 +132,8 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 
 // Interface guards
 var (
+	_ caddy.Provisioner           = (*TXTDirect)(nil)
+	_ caddy.CleanerUpper          = (*TXTDirect)(nil)
 	_ caddyhttp.MiddlewareHandler = (*TXTDirect)(nil)
 	_ caddyfile.Unmarshaler       = (*TXTDirect)(nil)
 )
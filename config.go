@@ -1,15 +1,15 @@
 package txtdirect
 
 import (
-	"io/ioutil"
-	"log"
-	"os"
+	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-var allOptions = []string{"host", "path", "gometa", "www"}
+var allOptions = []string{"host", "path", "gometa", "alias", "www"}
 
 // Config contains the middleware's configuration
 type Config struct {
@@ -18,6 +18,226 @@ type Config struct {
 	Resolver  string   `json:"resolver,omitempty"`
 	LogOutput string   `json:"logfile,omitempty"`
 	Qr        Qr
+
+	// LogFormat is the format of the request logs written to LogOutput.
+	// It can be "text" or "json" for one JSON object per line with the
+	// request's details. Defaults to "text".
+	LogFormat string `json:"logformat,omitempty"`
+
+	// HostNormalization are the steps applied in order to the request's
+	// host before its record is looked up. The steps are "lowercase",
+	// "strip_port", "strip_trailing_dot" and "punycode" to convert the
+	// internationalized hosts. The trailing dot is always removed, so
+	// "strip_trailing_dot" doesn't have to be listed.
+	HostNormalization []string `json:"host_normalization,omitempty"`
+
+	// WildcardPolicy is the order of the lookups used to find a host's
+	// record after the host itself. "specific-first" queries the host's
+	// "_" subzone before the wildcard that replaces the host's first
+	// label with "_", "apex-first" queries the wildcard first.
+	// Defaults to "specific-first".
+	WildcardPolicy string `json:"wildcard_policy,omitempty"`
+
+	// NotFoundChain are the handlers tried in order for the hosts without
+	// a record. "body" serves NotFoundBody, "redirect" redirects to the
+	// Redirect address and "404" responds with a 404. The handlers that
+	// aren't configured are skipped. Defaults to the global fallback.
+	NotFoundChain []string `json:"not_found_chain,omitempty"`
+
+	// NotFoundBody is the body served by the "body" NotFoundChain handler
+	NotFoundBody string `json:"not_found_body,omitempty"`
+
+	// TrustedProxies are the IPs or CIDRs of the proxies in front of
+	// TXTDirect. The X-Forwarded-Proto header used by fromscheme= is only
+	// honored on the requests coming from one of them.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// EnablePerHost overrides the enabled types for specific hosts,
+	// so risky types can be enabled only where they're needed
+	EnablePerHost map[string][]string `json:"enable_per_host,omitempty"`
+
+	// WWWRedirectCode is the status code of the redirects to the www
+	// subdomain when the "www" option is enabled. It can be 301 or 308
+	// to preserve the request method. Defaults to 301.
+	WWWRedirectCode int `json:"www_redirect_code,omitempty"`
+
+	// MDNS resolves the .local zones using multicast DNS
+	MDNS bool `json:"mdns,omitempty"`
+
+	// Use0x20 randomizes the case of the query names and rejects the
+	// responses that don't preserve it to make spoofing harder
+	Use0x20 bool `json:"use_0x20,omitempty"`
+
+	// FollowAliases queries the target of a zone's alias if the resolver
+	// only returned the alias, e.g. for an ALIAS/ANAME at the apex that
+	// the provider doesn't flatten. Up to 8 aliases are followed.
+	FollowAliases bool `json:"follow_aliases,omitempty"`
+
+	// RetryOnEmpty retries the query to the custom resolver once
+	// if it returned a successful but empty answer
+	RetryOnEmpty bool `json:"retry_on_empty,omitempty"`
+
+	// ResolverProtocol is the protocol used to query the custom resolver.
+	// It can be "udp", "tcp", "doh" or "dot". For "doh" the resolver is
+	// the DNS-over-HTTPS endpoint URL and "dot" uses port 853 if the
+	// resolver doesn't have a port. Defaults to "udp".
+	ResolverProtocol string `json:"resolver_protocol,omitempty"`
+
+	// ResolverHeaders are added to the requests sent to the "doh"
+	// resolver, e.g. an Authorization header for the providers that
+	// require an API token
+	ResolverHeaders map[string]string `json:"resolver_headers,omitempty"`
+
+	// DNSTCPOnly sends all of the DNS queries over TCP instead of UDP,
+	// including the ones to the system's resolver, to avoid truncated
+	// and spoofed UDP responses
+	DNSTCPOnly bool `json:"dns_tcp_only,omitempty"`
+
+	// ResolverServerName is the name used to verify the resolver's
+	// certificate for "dot". Defaults to the host of the resolver.
+	ResolverServerName string `json:"resolver_server_name,omitempty"`
+
+	// ResolverInsecureSkipVerify disables the verification of the
+	// resolver's certificate for "dot". Only meant for testing.
+	ResolverInsecureSkipVerify bool `json:"resolver_insecure_skip_verify,omitempty"`
+
+	// Resolvers are queried at the same time as Resolver when ResolverRace
+	// is enabled and the first successful answer is used
+	Resolvers []string `json:"resolvers,omitempty"`
+
+	// ResolverRace races Resolver and Resolvers for each query instead
+	// of only querying Resolver
+	ResolverRace bool `json:"resolver_race,omitempty"`
+
+	// SecondaryResolver is queried when a zone doesn't exist on the
+	// primary resolver, e.g. while migrating between DNS providers
+	SecondaryResolver string `json:"secondary_resolver,omitempty"`
+
+	// HealthCheckInterval enables the health checks of the to= targets
+	// lists. The first healthy target is used instead of a weighted one
+	// and the targets are checked with HEAD requests on this interval.
+	HealthCheckInterval time.Duration `json:"health_check_interval,omitempty"`
+
+	// HealthCheckTimeout is the timeout of each health check request.
+	// Defaults to 5s.
+	HealthCheckTimeout time.Duration `json:"health_check_timeout,omitempty"`
+
+	// RecordAPI is the base URL of an HTTP API that's queried with
+	// "GET /records?host=<host>" when a zone can't be resolved over DNS.
+	// It returns the records as {"txt": ["v=txtv0;..."], "ttl": 300}.
+	RecordAPI string `json:"record_api,omitempty"`
+
+	// WarmupHosts are resolved by Warmup on startup
+	WarmupHosts []string `json:"warmup_hosts,omitempty"`
+
+	// MaxTXTAnswers limits the number of TXT records accepted from a
+	// single zone. Zero means unlimited.
+	MaxTXTAnswers int `json:"max_txt_answers,omitempty"`
+
+	// ShuffleAnswers picks one of the txtdirect records randomly when a
+	// zone returns more than one of them, e.g. for DNS load balancing.
+	// Otherwise zones with multiple records are rejected.
+	ShuffleAnswers bool `json:"shuffle_answers,omitempty"`
+
+	// MaxConcurrentQueries limits the number of DNS queries running at
+	// the same time across all requests. Zero means unlimited.
+	MaxConcurrentQueries int `json:"max_concurrent_queries,omitempty"`
+
+	// QueryRetries is the number of times a query is retried after
+	// transient failures like timeouts. Defaults to 2, a negative
+	// value disables the retries.
+	QueryRetries int `json:"query_retries,omitempty"`
+
+	// QueryRetryBackoff is the delay before the first retry, which is
+	// doubled after each attempt. Defaults to 100ms.
+	QueryRetryBackoff time.Duration `json:"query_retry_backoff,omitempty"`
+
+	// CacheEnable caches the TXT records in memory until their TTL
+	// elapses. The queries are sent using the miekg/dns client since
+	// net.Resolver doesn't expose the TTLs.
+	CacheEnable bool `json:"cache_enable,omitempty"`
+
+	// StaleOnError serves the expired cached records of a zone when it
+	// can't be resolved, e.g. while the resolver is down. It requires
+	// CacheEnable and the zones that don't exist aren't served stale.
+	StaleOnError bool `json:"stale_on_error,omitempty"`
+
+	// CacheMaxEntries limits the number of cached zones, the least
+	// recently used ones get evicted first. Defaults to 1024.
+	CacheMaxEntries int `json:"cache_max_entries,omitempty"`
+
+	// DNSClient sends the TXT queries using the miekg/dns client instead
+	// of net.Resolver. It's also used automatically when one of the
+	// options below that net.Resolver doesn't support is set.
+	DNSClient bool `json:"dns_client,omitempty"`
+
+	// DNSCookies enables EDNS0 DNS Cookies (RFC 7873) on the
+	// queries sent to the custom resolver
+	DNSCookies bool `json:"dns_cookies,omitempty"`
+
+	// UDPBufferSize is the EDNS0 UDP buffer size advertised to the custom
+	// resolver. Larger sizes let big TXT answers fit in a single UDP
+	// response instead of falling back to TCP. Defaults to 1232.
+	UDPBufferSize uint16 `json:"udp_buffer_size,omitempty"`
+
+	// DNSClass is the class of the TXT queries sent to the custom
+	// resolver, e.g. "CH". Defaults to "IN".
+	DNSClass string `json:"dns_class,omitempty"`
+
+	// ServerTiming adds a Server-Timing header to the responses with
+	// the time spent on DNS lookups and record parsing
+	ServerTiming bool `json:"server_timing,omitempty"`
+
+	// DebugHeaders adds the X-TXTDirect-Chain header to the responses with
+	// the zone and type of each record visited to resolve the request
+	DebugHeaders bool `json:"debug_headers,omitempty"`
+
+	// SchemaValidate checks every parsed record against recordSchema, e.g.
+	// the fields required by its type or only allowed in other types and
+	// the ranges of the numeric fields, and rejects the invalid ones
+	SchemaValidate bool `json:"schema_validate,omitempty"`
+
+	// OnRedirect is called after each redirect served by TXTDirect
+	OnRedirect func(RedirectEvent) `json:"-"`
+
+	// FlagEvaluator checks if the feature flag in a record's flag= field
+	// is on for the request. The records with a flag always fall back
+	// if it isn't set.
+	FlagEvaluator func(flag string, r *http.Request) bool `json:"-"`
+
+	// RecordParsers are called for the record fields that ParseRecord
+	// doesn't handle itself, keyed by the field's lowercase name
+	RecordParsers map[string]func(key, value string, r *Record) error `json:"-"`
+
+	// NonceKey is the HMAC key used to sign the nonces added to the
+	// targets of the records with the nonce= field
+	NonceKey string `json:"nonce_key,omitempty"`
+}
+
+// Validate checks the options that can't be checked while the requests
+// are served. It's meant to be called when the config is loaded.
+func (c Config) Validate() error {
+	if err := validateHostNormalization(c.HostNormalization); err != nil {
+		return err
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enabledTypes returns the types enabled for the given host, which are
+// the ones from EnablePerHost if the host has an entry or Enable otherwise
+func (c Config) enabledTypes(host string) []string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if enable, ok := c.EnablePerHost[strings.ToLower(host)]; ok {
+		return enable
+	}
+	return c.Enable
 }
 
 func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
@@ -25,6 +245,7 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 	var redirect string
 	var resolver string
 	var logfile string
+	var logformat string
 
 	for d.Next() {
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
@@ -62,6 +283,13 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 				}
 				resolver = resolverAddr[0]
 
+			case "logformat":
+				format := d.RemainingArgs()
+				if len(format) != 1 || (format[0] != "text" && format[0] != "json") {
+					return nil, d.ArgErr()
+				}
+				logformat = format[0]
+
 			case "logfile":
 				logfile = "stdout"
 				// Set stdout as the default value
@@ -83,10 +311,9 @@ func ParseCaddy(d *caddyfile.Dispenser) (*Config, error) {
 		Redirect:  redirect,
 		Resolver:  resolver,
 		LogOutput: logfile,
+		LogFormat: logformat,
 	}
 
-	parseLogfile(logfile)
-
 	return &conf, nil
 }
 
@@ -104,21 +331,3 @@ func removeArrayFromArray(array, toBeRemoved []string) []string {
 	}
 	return t
 }
-
-func parseLogfile(logfile string) {
-	switch logfile {
-	case "stdout":
-		log.SetOutput(os.Stdout)
-	case "stderr":
-		log.SetOutput(os.Stderr)
-	case "":
-		log.SetOutput(ioutil.Discard)
-	default:
-		log.SetOutput(&lumberjack.Logger{
-			Filename:   logfile,
-			MaxSize:    100,
-			MaxAge:     14,
-			MaxBackups: 10,
-		})
-	}
-}
@@ -0,0 +1,92 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of the DNS messages sent
+// and received over DNS-over-HTTPS (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohClient is the HTTP client used for the DNS-over-HTTPS queries
+var dohClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// dohLookupTXT sends a TXT query for the given zone to the DNS-over-HTTPS
+// endpoint from Config.Resolver using an RFC 8484 POST request
+func dohLookupTXT(zone string, ctx context.Context, c Config) (txtResult, error) {
+	m, err := newQuery(zone, dns.TypeTXT, c)
+	if err != nil {
+		return txtResult{}, err
+	}
+	// RFC 8484 recommends the ID 0 to make the responses cache friendly
+	m.Id = 0
+
+	packed, err := m.Pack()
+	if err != nil {
+		return txtResult{}, err
+	}
+
+	req, err := http.NewRequest("POST", c.Resolver, bytes.NewReader(packed))
+	if err != nil {
+		return txtResult{}, fmt.Errorf("invalid DoH endpoint %s: %s", c.Resolver, err)
+	}
+	req = req.WithContext(ctx)
+	for header, value := range c.ResolverHeaders {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	res, err := dohClient.Do(req)
+	if err != nil {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: %s", zone, c.Resolver, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: unexpected status %s", zone, c.Resolver, res.Status)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != dohMediaType {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: unexpected content type %s", zone, c.Resolver, ct)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: %s", zone, c.Resolver, err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: invalid DNS message: %s", zone, c.Resolver, err)
+	}
+
+	result, err := txtAnswers(zone, c.Resolver, resp)
+	if err != nil {
+		return txtResult{}, err
+	}
+	if len(result.Txts) == 0 {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: no TXT records found", zone, c.Resolver)
+	}
+	return result, nil
+}
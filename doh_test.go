@@ -0,0 +1,132 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_queryDoH(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var resp *dns.Msg
+		if m.Question[0].Name == "_redirect.doh.example.com." {
+			resp = txtReply(m, "v=txtv0;to=https://doh.test")
+		} else {
+			resp = new(dns.Msg)
+			resp.SetRcode(m, dns.RcodeNameError)
+		}
+		packed, _ := resp.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	c := Config{
+		Resolver:         server.URL + "/dns-query",
+		ResolverProtocol: "doh",
+	}
+	txts, err := query("doh.example.com", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://doh.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+
+	if _, err := dohLookupTXT("_redirect.missing.example.com.", context.Background(), c); !isNotFound(err) {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
+
+func Test_queryDoHHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, _ := txtReply(m, "v=txtv0;to=https://doh.test").Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(packed)
+	}))
+	defer server.Close()
+
+	c := Config{
+		Resolver:         server.URL + "/dns-query",
+		ResolverProtocol: "doh",
+	}
+	if _, err := query("doh.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected an error without the Authorization header")
+	}
+
+	c.ResolverHeaders = map[string]string{
+		"Authorization": "Bearer token",
+		// The DNS message media type can't be overridden
+		"Content-Type": "text/plain",
+	}
+	txts, err := query("doh.example.com", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://doh.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+}
+
+func Test_queryDoHContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := Config{
+		Resolver:         server.URL,
+		ResolverProtocol: "doh",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := query("doh.example.com", ctx, c); err == nil {
+		t.Errorf("Expected an error for a canceled query")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected the query to stop on context cancellation, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotTimeout is the maximum time for dialing a DNS-over-TLS resolver
+// and for each exchange if the context doesn't have a deadline
+const dotTimeout = 5 * time.Second
+
+// dotConn is a DNS-over-TLS connection shared by the lookups
+// sent to the same resolver
+type dotConn struct {
+	sync.Mutex
+	conn *dns.Conn
+}
+
+// dotConns keeps the DNS-over-TLS connections to reuse them across lookups.
+// They're keyed by the resolver and its TLS settings.
+var dotConns = struct {
+	sync.Mutex
+	conns map[string]*dotConn
+}{conns: map[string]*dotConn{}}
+
+// dotExchange sends the given message to the resolver over DNS-over-TLS
+// (RFC 7858). The connection is kept open for the next lookups and gets
+// dialed again if the resolver closed it in the meantime.
+func dotExchange(m *dns.Msg, ctx context.Context, c Config, resolver string) (*dns.Msg, error) {
+	key := resolver + "|" + c.ResolverServerName + "|" + strconv.FormatBool(c.ResolverInsecureSkipVerify)
+
+	dotConns.Lock()
+	dc, ok := dotConns.conns[key]
+	if !ok {
+		dc = &dotConn{}
+		dotConns.conns[key] = dc
+	}
+	dotConns.Unlock()
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	reused := dc.conn != nil
+	for {
+		if dc.conn == nil {
+			conn, err := dotDial(ctx, c, resolver)
+			if err != nil {
+				return nil, err
+			}
+			dc.conn = conn
+		}
+
+		resp, err := dotWriteRead(dc.conn, m, ctx)
+		if err == nil {
+			return resp, nil
+		}
+		dc.conn.Close()
+		dc.conn = nil
+
+		// Retry once on a fresh connection if the idle one was closed
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+		reused = false
+	}
+}
+
+// dotDial opens a TLS connection to the resolver and verifies its
+// certificate using Config.ResolverServerName or the resolver's host
+func dotDial(ctx context.Context, c Config, resolver string) (*dns.Conn, error) {
+	serverName := c.ResolverServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(resolver)
+		if err != nil {
+			return nil, err
+		}
+		serverName = host
+	}
+
+	d := net.Dialer{Timeout: dotTimeout}
+	raw, err := d.DialContext(ctx, "tcp", resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(raw, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: c.ResolverInsecureSkipVerify,
+	})
+	conn.SetDeadline(deadline(ctx, dotTimeout))
+	if err := conn.Handshake(); err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %s", resolver, err)
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// dotWriteRead sends the message on the given connection and
+// waits for the response with the same ID
+func dotWriteRead(conn *dns.Conn, m *dns.Msg, ctx context.Context) (*dns.Msg, error) {
+	conn.SetDeadline(deadline(ctx, dotTimeout))
+	if err := conn.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
+
+// deadline returns the context's deadline or the given timeout from now
+// if the context doesn't have one
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(timeout)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDoTServer runs a DNS-over-TLS server with a self-signed certificate
+// on a random local port. It returns the server's address and a function
+// that returns the number of accepted connections and the SNI of the last one.
+func startDoTServer(t *testing.T, handler dns.HandlerFunc) (string, func() (int, string)) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.test"},
+		DNSNames:     []string{"dns.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var conns int
+	var sni string
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mu.Lock()
+			conns++
+			sni = hello.ServerName
+			mu.Unlock()
+			return nil, nil
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start the DNS server: %s", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		Net:               "tcp-tls",
+		Listener:          tls.NewListener(l, config),
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	return l.Addr().String(), func() (int, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns, sni
+	}
+}
+
+func Test_queryDoT(t *testing.T) {
+	addr, stats := startDoTServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://dot.test"))
+	})
+
+	c := Config{
+		Resolver:                   addr,
+		ResolverProtocol:           "dot",
+		ResolverServerName:         "dns.example.test",
+		ResolverInsecureSkipVerify: true,
+	}
+	for i := 0; i < 3; i++ {
+		txts, err := query("_redirect.dot.example.com.", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if txts[0] != "v=txtv0;to=https://dot.test" {
+			t.Errorf("Unexpected TXT record: %s", txts[0])
+		}
+	}
+
+	conns, sni := stats()
+	if conns != 1 {
+		t.Errorf("Expected the lookups to reuse a single connection, got %d connections", conns)
+	}
+	if sni != c.ResolverServerName {
+		t.Errorf("Expected the server name to be %s, got %s", c.ResolverServerName, sni)
+	}
+}
+
+func Test_queryDoTHandshake(t *testing.T) {
+	addr, _ := startDoTServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://dot.test"))
+	})
+
+	// The self-signed certificate fails the verification
+	c := Config{
+		Resolver:           addr,
+		ResolverProtocol:   "dot",
+		ResolverServerName: "dns.example.test",
+	}
+	_, err := query("_redirect.dot.example.com.", context.Background(), c)
+	if err == nil || !strings.Contains(err.Error(), "TLS handshake") {
+		t.Errorf("Expected a TLS handshake error, got %v", err)
+	}
+}
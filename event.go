@@ -0,0 +1,31 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import "time"
+
+// RedirectEvent describes a redirect served by TXTDirect.
+// It's passed to the Config.OnRedirect callback.
+type RedirectEvent struct {
+	Host     string
+	Target   string
+	Type     string
+	Code     int
+	Duration time.Duration
+}
+
+// isRedirect checks if the given status code is a redirection
+func isRedirect(code int) bool {
+	return code >= 300 && code < 400
+}
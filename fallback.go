@@ -1,8 +1,6 @@
 package txtdirect
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -30,8 +28,8 @@ type Fallback struct {
 // and if it's not provided it will check txtdirect config for
 // default fallback address
 func fallback(w http.ResponseWriter, r *http.Request, fallbackType string, code int, c Config) {
-	if code == http.StatusMovedPermanently {
-		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", Status301CacheAge))
+	if isPermanent(code) {
+		addPermanentCacheControl(w, Status301CacheAge)
 	}
 	w.Header().Add("Status-Code", strconv.Itoa(code))
 
@@ -53,19 +51,64 @@ func fallback(w http.ResponseWriter, r *http.Request, fallbackType string, code
 				f.globalFallbacks(f.lastRecord.Type)
 			}
 		}
-		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, w.Header().Get("Location"))
+		logRedirect(c, r, f.lastRecord.Type, w.Header().Get("Location"), f.code)
 		return
 	}
 
 	f.globalFallbacks("")
 
-	log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, w.Header().Get("Location"))
+	logRedirect(c, r, "", w.Header().Get("Location"), f.code)
+}
+
+// notFoundFallback responds to the requests for the hosts without a
+// record using the first configured handler in Config.NotFoundChain.
+// It returns false if none of the handlers could be used.
+func notFoundFallback(w http.ResponseWriter, r *http.Request, c Config) bool {
+	for _, handler := range c.NotFoundChain {
+		switch handler {
+		case "body":
+			if c.NotFoundBody == "" {
+				continue
+			}
+			w.Header().Set("Content-Type", http.DetectContentType([]byte(c.NotFoundBody)))
+			w.Header().Set("Status-Code", strconv.Itoa(http.StatusNotFound))
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(c.NotFoundBody))
+			return true
+
+		case "redirect":
+			if c.Redirect == "" {
+				continue
+			}
+			w.Header().Set("Status-Code", strconv.Itoa(http.StatusFound))
+			http.Redirect(w, r, c.Redirect, http.StatusFound)
+			logRedirect(c, r, "", c.Redirect, http.StatusFound)
+			return true
+
+		case "404":
+			w.Header().Set("Status-Code", strconv.Itoa(http.StatusNotFound))
+			http.NotFound(w, r)
+			return true
+
+		default:
+			logf(c, r, "Unknown not found handler %s", handler)
+		}
+	}
+	return false
 }
 
 func (f *Fallback) globalFallbacks(recordType string) {
 	if contains(f.config.Enable, "www") {
 		s := strings.Join([]string{defaultProtocol, "://", defaultSub, ".", f.request.URL.Host}, "")
 
+		// The canonical host never changes, so it's always a permanent redirect
+		f.code = http.StatusMovedPermanently
+		if f.config.WWWRedirectCode == http.StatusPermanentRedirect {
+			f.code = http.StatusPermanentRedirect
+		}
+		addPermanentCacheControl(f.rw, Status301CacheAge)
+		f.rw.Header().Set("Status-Code", strconv.Itoa(f.code))
+
 		http.Redirect(f.rw, f.request, s, f.code)
 
 	} else if f.config.Redirect != "" {
@@ -77,6 +120,8 @@ func (f *Fallback) globalFallbacks(recordType string) {
 
 	} else {
 		http.NotFound(f.rw, f.request)
+
+		f.code = http.StatusNotFound
 	}
 }
 
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func Test_fallback(t *testing.T) {
@@ -16,6 +18,8 @@ func Test_fallback(t *testing.T) {
 		fallbackType string
 		enable       []string
 		url          string
+		wwwCode      int
+		code         int
 		expected     string
 	}{
 		{
@@ -66,6 +70,18 @@ func Test_fallback(t *testing.T) {
 			enable:       []string{"www"},
 			url:          "https://go.to.www.test",
 			fallbackType: "global",
+			code:         301,
+			expected:     "https://www.go.to.www.test",
+		},
+		{
+			record: Record{
+				Code: 302,
+			},
+			enable:       []string{"www"},
+			url:          "https://go.to.www.test",
+			fallbackType: "global",
+			wwwCode:      308,
+			code:         308,
 			expected:     "https://www.go.to.www.test",
 		},
 	}
@@ -78,12 +94,20 @@ func Test_fallback(t *testing.T) {
 		req = test.record.addToContext(req)
 		resp := httptest.NewRecorder()
 		c := Config{
-			Redirect: test.redirect,
-			Enable:   test.enable,
+			Redirect:        test.redirect,
+			Enable:          test.enable,
+			WWWRedirectCode: test.wwwCode,
 		}
 		fallback(resp, req, test.fallbackType, test.record.Code, c)
-		if resp.Code != test.record.Code {
-			t.Errorf("Response's status code (%d) doesn't match with expected status code (%d).", resp.Code, test.record.Code)
+		code := test.record.Code
+		if test.code != 0 {
+			code = test.code
+		}
+		if resp.Code != code {
+			t.Errorf("Response's status code (%d) doesn't match with expected status code (%d).", resp.Code, code)
+		}
+		if test.code != 0 && resp.Header().Get("Cache-Control") != fmt.Sprintf("max-age=%d", Status301CacheAge) {
+			t.Errorf("Expected the canonical redirect to be cached, got Cache-Control '%s'", resp.Header().Get("Cache-Control"))
 		}
 		if !strings.Contains(resp.Body.String(), test.expected) {
 			t.Errorf("Expected response to contain \"%s\".\n\n%s\n\n", test.expected, resp.Body.String())
@@ -170,3 +194,81 @@ func checkLocationHeader(t *testing.T, location, item string) {
 		t.Errorf("Expected %s got %s", item, location)
 	}
 }
+
+func Test_notFoundFallback(t *testing.T) {
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		rcode := dns.RcodeNameError
+		if strings.HasSuffix(r.Question[0].Name, ".test.") {
+			rcode = dns.RcodeServerFailure
+		}
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	})
+
+	tests := []struct {
+		host     string
+		chain    []string
+		body     string
+		code     int
+		location string
+	}{
+		{
+			host:  "missing.example.com",
+			chain: []string{"body", "redirect", "404"},
+			body:  "<html><body>Nothing here yet</body></html>",
+			code:  http.StatusNotFound,
+		},
+		{
+			host:     "missing.example.com",
+			chain:    []string{"body", "redirect", "404"},
+			code:     http.StatusFound,
+			location: "https://fallback.test",
+		},
+		{
+			host:  "missing.example.com",
+			chain: []string{"404", "redirect"},
+			code:  http.StatusNotFound,
+		},
+		{
+			host:     "missing.example.com",
+			code:     http.StatusMovedPermanently,
+			location: "https://fallback.test",
+		},
+		{
+			host:     "servfail.test",
+			chain:    []string{"404"},
+			code:     http.StatusMovedPermanently,
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:      addr,
+			Enable:        []string{"host"},
+			Redirect:      "https://fallback.test",
+			QueryRetries:  -1,
+			NotFoundChain: test.chain,
+			NotFoundBody:  test.body,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err.Error())
+		}
+		if resp.Code != test.code {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.code, resp.Code)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location %q, got %q", i, test.location, location)
+		}
+		if test.body != "" {
+			if body := resp.Body.String(); body != test.body {
+				t.Errorf("Test %d: Expected the not found body, got %q", i, body)
+			}
+			if ct := resp.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("Test %d: Expected an HTML Content-Type, got %s", i, ct)
+			}
+		}
+	}
+}
@@ -14,6 +14,7 @@ limitations under the License.
 package txtdirect
 
 import (
+	"bytes"
 	"html/template"
 	"net/http"
 	"strings"
@@ -40,13 +41,36 @@ func NewGometa(w http.ResponseWriter, r *http.Request, rec Record, c Config) *Go
 var tmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 <html>
 <head>
-<meta name="go-import" content="{{.Host}}{{.Path}} {{.Vcs}} {{.NewURL}}">
-{{if .HasGoSource}}<meta name="go-source" content="{{.Host}}{{.Path}} _ {{.NewURL}}/tree/master{/dir} {{.NewURL}}/blob/master{/dir}/{file}#L{line}">{{end}}
+<meta name="go-import" content="{{.Prefix}} {{.Vcs}} {{.NewURL}}">
+{{if .GoSource}}<meta name="go-source" content="{{.Prefix}} {{.GoSource}}">{{end}}
 </head>
+<body>
+Redirecting to <a href="{{.Link}}">{{.Link}}</a>.
+</body>
 </html>`))
 
+// goSource returns the home, directory and file parts of the go-source
+// meta tag. The home page comes from the record's website= field and the
+// directory and file templates are only known for GitHub repositories.
+// It returns an empty string when neither of them is available.
+func goSource(rec Record) string {
+	home, dir, file := "_", "_", "_"
+	if rec.Website != "" {
+		home = rec.Website
+	}
+	if strings.Contains(rec.To, "github.com") {
+		dir = rec.To + "/tree/master{/dir}"
+		file = rec.To + "/blob/master{/dir}/{file}#L{line}"
+	}
+	if home == "_" && dir == "_" {
+		return ""
+	}
+	return strings.Join([]string{home, dir, file}, " ")
+}
+
 // Serve executes a template on the given ResponseWriter
-// that contains go-import meta tag
+// that contains go-import and go-source meta tags and a link
+// to the package's documentation for browsers
 func (g *Gometa) Serve() error {
 	if g.rec.Vcs == "" {
 		g.rec.Vcs = "git"
@@ -55,22 +79,64 @@ func (g *Gometa) Serve() error {
 		g.req.URL.Path = ""
 	}
 
-	gosource := strings.Contains(g.rec.To, "github.com")
+	link := g.rec.Website
+	if link == "" {
+		link = "https://pkg.go.dev/" + g.req.Host + g.req.URL.Path
+	}
 
 	// RequestsByStatus.WithLabelValues(g.req.Host, strconv.Itoa(http.StatusFound)).Add(1)
-	return tmpl.Execute(g.rw, struct {
-		Host        string
-		Path        string
-		Vcs         string
-		NewURL      string
-		HasGoSource bool
+	var body bytes.Buffer
+	err := tmpl.Execute(&body, struct {
+		Prefix   string
+		Vcs      string
+		NewURL   string
+		GoSource string
+		Link     string
 	}{
-		g.req.Host,
-		g.req.URL.Path,
+		g.importPrefix(),
 		g.rec.Vcs,
 		g.rec.To,
-		gosource,
+		goSource(g.rec),
+		link,
 	})
+	if err != nil {
+		return err
+	}
+
+	g.rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return writeBody(g.rw, g.req, body.Bytes(), g.rec.Compress)
+}
+
+// importPrefix returns the import path prefix of the repository for the
+// go-import meta tag. For the repositories with multiple modules the
+// record's from= field tells which part of the requested path is the
+// repository's root: a literal path like "/repo" or a template like
+// "/$1/$2" for the first two path segments. Without a from= field the
+// whole requested path is used.
+func (g *Gometa) importPrefix() string {
+	path := g.req.URL.Path
+	from := g.rec.From
+	if from == "" {
+		return g.req.Host + path
+	}
+
+	if !strings.Contains(from, "$") {
+		from = strings.TrimSuffix(from, "/")
+		if path == from || strings.HasPrefix(path, from+"/") {
+			return g.req.Host + from
+		}
+		return g.req.Host + path
+	}
+
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if n := len(FromRegex.FindAllString(from, -1)); n < len(segments) {
+		segments = segments[:n]
+	}
+	prefix := strings.Join(segments, "/")
+	if prefix == "" {
+		return g.req.Host
+	}
+	return g.req.Host + "/" + prefix
 }
 
 // ValidQuery checks the request query to make sure the requests are
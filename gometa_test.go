@@ -14,9 +14,14 @@ limitations under the License.
 package txtdirect
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -40,6 +45,9 @@ func TestGometa(t *testing.T) {
 <meta name="go-import" content="example.com/testing git redirect.com/my-go-pkg">
 
 </head>
+<body>
+Redirecting to <a href="https://pkg.go.dev/example.com/testing">https://pkg.go.dev/example.com/testing</a>.
+</body>
 </html>`,
 		},
 		{
@@ -52,6 +60,9 @@ func TestGometa(t *testing.T) {
 <meta name="go-import" content="empty.com/testing git ">
 
 </head>
+<body>
+Redirecting to <a href="https://pkg.go.dev/empty.com/testing">https://pkg.go.dev/empty.com/testing</a>.
+</body>
 </html>`,
 		},
 		{
@@ -67,6 +78,9 @@ func TestGometa(t *testing.T) {
 <meta name="go-import" content="root.com/testing git redirect.com/my-root-package">
 
 </head>
+<body>
+Redirecting to <a href="https://pkg.go.dev/root.com/testing">https://pkg.go.dev/root.com/testing</a>.
+</body>
 </html>`,
 		},
 		{
@@ -82,6 +96,47 @@ func TestGometa(t *testing.T) {
 <meta name="go-import" content="root.com/testing git github.com/txtdirect/txtdirect">
 <meta name="go-source" content="root.com/testing _ github.com/txtdirect/txtdirect/tree/master{/dir} github.com/txtdirect/txtdirect/blob/master{/dir}/{file}#L{line}">
 </head>
+<body>
+Redirecting to <a href="https://pkg.go.dev/root.com/testing">https://pkg.go.dev/root.com/testing</a>.
+</body>
+</html>`,
+		},
+		{
+			host: "website.com",
+			path: "/testing",
+			record: Record{
+				Vcs:     "hg",
+				To:      "https://hg.example.com/my-go-pkg",
+				Website: "https://docs.example.com",
+			},
+			expected: `<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="website.com/testing hg https://hg.example.com/my-go-pkg">
+<meta name="go-source" content="website.com/testing https://docs.example.com _ _">
+</head>
+<body>
+Redirecting to <a href="https://docs.example.com">https://docs.example.com</a>.
+</body>
+</html>`,
+		},
+		{
+			host: "website.com",
+			path: "/testing",
+			record: Record{
+				Vcs:     "git",
+				To:      "github.com/txtdirect/txtdirect",
+				Website: "https://txtdirect.org",
+			},
+			expected: `<!DOCTYPE html>
+<html>
+<head>
+<meta name="go-import" content="website.com/testing git github.com/txtdirect/txtdirect">
+<meta name="go-source" content="website.com/testing https://txtdirect.org github.com/txtdirect/txtdirect/tree/master{/dir} github.com/txtdirect/txtdirect/blob/master{/dir}/{file}#L{line}">
+</head>
+<body>
+Redirecting to <a href="https://txtdirect.org">https://txtdirect.org</a>.
+</body>
 </html>`,
 		},
 	}
@@ -105,3 +160,189 @@ func TestGometa(t *testing.T) {
 		}
 	}
 }
+
+func TestGometaImportPrefix(t *testing.T) {
+	tests := []struct {
+		from     string
+		path     string
+		expected string
+	}{
+		{
+			path:     "/repo/sub",
+			expected: "example.com/repo/sub",
+		},
+		{
+			from:     "/$1",
+			path:     "/repo/sub",
+			expected: "example.com/repo",
+		},
+		{
+			from:     "/$1",
+			path:     "/repo",
+			expected: "example.com/repo",
+		},
+		{
+			from:     "/$1/$2",
+			path:     "/org/repo/sub/pkg",
+			expected: "example.com/org/repo",
+		},
+		{
+			from:     "/$1",
+			path:     "/",
+			expected: "example.com",
+		},
+		{
+			from:     "/repo",
+			path:     "/repo/sub/pkg",
+			expected: "example.com/repo",
+		},
+		{
+			from:     "/repo/",
+			path:     "/repo",
+			expected: "example.com/repo",
+		},
+		{
+			from:     "/repo",
+			path:     "/repository/sub",
+			expected: "example.com/repository/sub",
+		},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com"+test.path+"?go-get=1", nil)
+		resp := httptest.NewRecorder()
+		record := Record{
+			Vcs:  "git",
+			To:   "https://git.example.com/monorepo",
+			From: test.from,
+		}
+		if err := NewGometa(resp, req, record, Config{}).Serve(); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		expected := fmt.Sprintf(`<meta name="go-import" content="%s git https://git.example.com/monorepo">`, test.expected)
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("Test %d: Expected the body to contain\n%s\ngot:\n%s", i, expected, resp.Body.String())
+		}
+	}
+}
+
+func TestRedirectGometaFrameOptions(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://frame.gometa.example.com/pkg?go-get=1", nil)
+	resp := httptest.NewRecorder()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"gometa"},
+	}
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(resp.Body.String(), `<meta name="go-import"`) {
+		t.Fatalf("Expected the go-import body to be served, got %s", resp.Body.String())
+	}
+	if got := resp.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("Expected X-Frame-Options to be DENY, got '%s'", got)
+	}
+	if got := resp.Header().Get("Content-Security-Policy"); got != "frame-ancestors 'none'" {
+		t.Errorf("Expected Content-Security-Policy to be frame-ancestors 'none', got '%s'", got)
+	}
+}
+
+func TestGometaCompress(t *testing.T) {
+	tests := []struct {
+		record     Record
+		compressed bool
+	}{
+		{
+			record: Record{
+				Vcs:      "git",
+				To:       "redirect.com/my-go-pkg",
+				Compress: 1024,
+			},
+			compressed: false,
+		},
+		{
+			record: Record{
+				Vcs:      "git",
+				To:       "redirect.com/" + strings.Repeat("my-go-pkg/", 150),
+				Compress: 1024,
+			},
+			compressed: true,
+		},
+	}
+
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/testing", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		resp := httptest.NewRecorder()
+		gometa := NewGometa(resp, req, test.record, Config{})
+
+		if err := gometa.Serve(); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+
+		if got := resp.Header().Get("Content-Encoding") == "gzip"; got != test.compressed {
+			t.Errorf("Test %d: Expected compressed to be %t, got %t", i, test.compressed, got)
+			continue
+		}
+
+		body := io.Reader(resp.Body)
+		if test.compressed {
+			gz, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Errorf("Test %d: Couldn't read the gzipped body: %s", i, err)
+				continue
+			}
+			body = gz
+		}
+		txt, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !strings.Contains(string(txt), test.record.To) {
+			t.Errorf("Test %d: Expected the body to contain %s", i, test.record.To)
+		}
+	}
+}
+
+func TestGometaETag(t *testing.T) {
+	record := Record{
+		Vcs: "git",
+		To:  "redirect.com/my-go-pkg",
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/testing", nil)
+	resp := httptest.NewRecorder()
+	if err := NewGometa(resp, req, record, Config{}).Serve(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	etag := resp.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expected the response to contain an ETag header")
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/testing", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp = httptest.NewRecorder()
+	if err := NewGometa(resp, req, record, Config{}).Serve(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Code != http.StatusNotModified {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotModified, resp.Code)
+	}
+	if resp.Body.Len() != 0 {
+		t.Errorf("Expected an empty body, got %s", resp.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "https://example.com/testing", nil)
+	req.Header.Set("If-None-Match", `"outdated"`)
+	resp = httptest.NewRecorder()
+	if err := NewGometa(resp, req, record, Config{}).Serve(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, resp.Code)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultHealthCheckTimeout is used when HealthCheckTimeout isn't set
+const defaultHealthCheckTimeout = 5 * time.Second
+
+// maxHealthTargets caps the number of checked origins. The origins that
+// don't fit are considered healthy without being checked.
+const maxHealthTargets = 1000
+
+// healthTargetExpiry is how long an origin is checked after the last
+// request that used it
+const healthTargetExpiry = 10 * time.Minute
+
+// health keeps the status of the to= targets of the served records
+var health = &healthChecker{}
+
+// healthChecker periodically sends HEAD requests to the watched targets'
+// origins in the background and keeps whether they're up or down
+type healthChecker struct {
+	mu      sync.Mutex
+	targets map[string]*healthTarget
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// healthTarget is the status of a checked origin
+type healthTarget struct {
+	up   bool
+	used time.Time
+}
+
+// targetOrigin returns the scheme and host of the given target after
+// it's expanded for the request, which its health is checked on. The
+// origin has to be in the raw target as it is, so the targets with
+// placeholders in the scheme or host get an empty origin and aren't
+// checked. Otherwise every request could add a new origin.
+func targetOrigin(raw, target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	origin := u.Scheme + "://" + u.Host
+	if !strings.HasPrefix(raw, origin) {
+		return ""
+	}
+	return origin
+}
+
+// watch adds the origins of the given targets to the checked ones and
+// starts the background checks if they aren't running yet
+func (h *healthChecker) watch(targets []WeightedTarget, c Config) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.register(targets)
+
+	if h.stop == nil {
+		timeout := c.HealthCheckTimeout
+		if timeout <= 0 {
+			timeout = defaultHealthCheckTimeout
+		}
+		h.stop = make(chan struct{})
+		h.wg.Add(1)
+		go h.run(c.HealthCheckInterval, timeout, h.stop)
+	}
+}
+
+// register adds the origins of the given targets to the checked ones
+// and marks them as used. The caller must hold the lock.
+func (h *healthChecker) register(targets []WeightedTarget) {
+	if h.targets == nil {
+		h.targets = make(map[string]*healthTarget)
+	}
+	for _, target := range targets {
+		if target.Origin == "" {
+			continue
+		}
+		if t, ok := h.targets[target.Origin]; ok {
+			t.used = now()
+			continue
+		}
+		if len(h.targets) >= maxHealthTargets {
+			continue
+		}
+		// Targets are considered healthy until they're checked
+		h.targets[target.Origin] = &healthTarget{up: true, used: now()}
+	}
+}
+
+func (h *healthChecker) run(interval, timeout time.Duration, stop chan struct{}) {
+	defer h.wg.Done()
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.checkAll(client)
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkAll sends a HEAD request to each origin and updates its status.
+// Origins that respond with a 5xx status code are considered down, and
+// the ones that haven't been used for healthTargetExpiry are dropped.
+func (h *healthChecker) checkAll(client *http.Client) {
+	h.mu.Lock()
+	targets := make([]string, 0, len(h.targets))
+	for origin, target := range h.targets {
+		if now().Sub(target.used) > healthTargetExpiry {
+			delete(h.targets, origin)
+			continue
+		}
+		targets = append(targets, origin)
+	}
+	h.mu.Unlock()
+
+	for _, origin := range targets {
+		up := false
+		res, err := client.Head(origin + "/")
+		if err == nil {
+			res.Body.Close()
+			up = res.StatusCode < http.StatusInternalServerError
+		}
+
+		h.mu.Lock()
+		// The targets are cleared if the checks got stopped meanwhile
+		if target, ok := h.targets[origin]; ok {
+			if target.up != up {
+				logger.Printf("[txtdirect]: Health check of %s changed to up=%t", origin, up)
+			}
+			target.up = up
+		}
+		h.mu.Unlock()
+	}
+}
+
+// firstHealthy returns the first target in the given list whose origin
+// isn't down
+func (h *healthChecker) firstHealthy(targets []WeightedTarget) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, target := range targets {
+		if t, ok := h.targets[target.Origin]; !ok || t.up {
+			return target.URL, true
+		}
+	}
+	return "", false
+}
+
+// StopHealthChecks stops the background health checks and waits for
+// the running checks to return. It's meant to be called on shutdown.
+func StopHealthChecks() {
+	health.mu.Lock()
+	if health.stop == nil {
+		health.mu.Unlock()
+		return
+	}
+	close(health.stop)
+	health.stop = nil
+	health.targets = nil
+	health.mu.Unlock()
+
+	health.wg.Wait()
+}
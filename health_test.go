@@ -0,0 +1,140 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRedirectHealthCheck(t *testing.T) {
+	t.Cleanup(StopHealthChecks)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "_redirect.failover.example.com.":
+			w.WriteMsg(txtReply(r, "v=txtv0;to="+down.URL+","+up.URL))
+		default:
+			w.WriteMsg(txtReply(r, "v=txtv0;to="+down.URL+","+down.URL+"/other"))
+		}
+	})
+	c := Config{
+		Resolver:            addr,
+		Enable:              []string{"host"},
+		Redirect:            "https://fallback.test",
+		HealthCheckInterval: 10 * time.Millisecond,
+		HealthCheckTimeout:  time.Second,
+	}
+
+	redirect := func(host string) string {
+		req := httptest.NewRequest("GET", "https://"+host+"/", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error occured: %s", err.Error())
+		}
+		return resp.Header().Get("Location")
+	}
+
+	// The first requests register the targets for the health checks
+	redirect("failover.example.com")
+	redirect("outage.example.com")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := health.firstHealthy([]WeightedTarget{{URL: down.URL, Origin: down.URL}}); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the targets of %s to be marked as down", down.URL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if location := redirect("failover.example.com"); location != up.URL {
+		t.Errorf("Expected the healthy target %s, got %s", up.URL, location)
+	}
+	if location := redirect("outage.example.com"); location != c.Redirect {
+		t.Errorf("Expected fallback when all of the targets are down, got %s", location)
+	}
+
+	StopHealthChecks()
+	if health.stop != nil {
+		t.Errorf("Expected the health checks to be stopped")
+	}
+}
+
+func Test_healthCheckerRegister(t *testing.T) {
+	current := time.Now()
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = time.Now })
+
+	h := &healthChecker{}
+
+	// The targets expanded for different requests share their origin
+	for _, path := range []string{"/a", "/b?x=1", "/c"} {
+		req := httptest.NewRequest("GET", "https://example.com"+path, nil)
+		rec, err := ParseRecord("v=txtv0;to=https://a.test{uri},http://b.test/;query=preserve", httptest.NewRecorder(), req, Config{Enable: []string{"host"}})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		h.register(rec.Targets)
+	}
+	if len(h.targets) != 2 || h.targets["https://a.test"] == nil || h.targets["http://b.test"] == nil {
+		t.Errorf("Expected the targets to be keyed on their origins, got %v", h.targets)
+	}
+
+	// Placeholders in the host can't be checked
+	h.register([]WeightedTarget{{URL: "https://example.com.test", Origin: targetOrigin("https://{host}.test", "https://example.com.test")}})
+	if len(h.targets) != 2 {
+		t.Errorf("Expected the targets with a placeholder host to be skipped, got %v", h.targets)
+	}
+
+	// Unused origins expire on the next check
+	current = current.Add(healthTargetExpiry / 2)
+	h.register([]WeightedTarget{{Origin: "https://a.test"}})
+	current = current.Add(healthTargetExpiry/2 + time.Second)
+	h.checkAll(&http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.String() != "https://a.test/" {
+			t.Errorf("Unexpected health check of %s", r.URL)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})})
+	if len(h.targets) != 1 || h.targets["https://a.test"] == nil {
+		t.Errorf("Expected only the recently used origin to be kept, got %v", h.targets)
+	}
+
+	// The number of origins is capped
+	for i := 0; i < 2*maxHealthTargets; i++ {
+		h.register([]WeightedTarget{{Origin: "https://" + strconv.Itoa(i) + ".test"}})
+	}
+	if len(h.targets) != maxHealthTargets {
+		t.Errorf("Expected %d origins, got %d", maxHealthTargets, len(h.targets))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
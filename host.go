@@ -1,8 +1,6 @@
 package txtdirect
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 )
@@ -29,15 +27,28 @@ func NewHost(w http.ResponseWriter, r *http.Request, rec Record, c Config) *Host
 func (h *Host) Redirect() error {
 	to, code, err := getBaseTarget(h.rec, h.req)
 	if err != nil {
-		log.Print("Fallback is triggered because an error has occurred: ", err)
+		logFallback(h.c, h.req, h.rec.Type, "an error has occurred: %s", err)
 		fallback(h.rw, h.req, "to", code, h.c)
 		return nil
 	}
-	log.Printf("[txtdirect]: %s > %s", h.req.Host+h.req.URL.Path, to)
-	if code == http.StatusMovedPermanently {
-		h.rw.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", Status301CacheAge))
+	// Send the requests to "/" to the rootredirect= target if it's set
+	if h.rec.RootRedirect != "" && (h.req.URL.Path == "" || h.req.URL.Path == "/") {
+		to = h.rec.RootRedirect
+	}
+	logRedirect(h.c, h.req, h.rec.Type, to, code)
+	h.rec.addCacheControl(h.rw, code)
+	h.rec.addRefresh(h.rw, to)
+	if h.rec.AltSvc != "" {
+		h.rw.Header().Set("Alt-Svc", h.rec.AltSvc)
 	}
 	h.rw.Header().Add("Status-Code", strconv.Itoa(code))
+	if h.rec.Reason != "" {
+		err := redirectWithReason(h.rw, to, code, h.rec.Reason)
+		if err == nil {
+			return nil
+		}
+		logf(h.c, h.req, "Couldn't use the custom reason phrase: %s", err.Error())
+	}
 	http.Redirect(h.rw, h.req, to, code)
 	return nil
 }
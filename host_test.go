@@ -0,0 +1,210 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHostRedirect(t *testing.T) {
+	refresh := 5
+	tests := []struct {
+		url      string
+		record   Record
+		location string
+		headers  map[string]string
+	}{
+		{
+			url: "https://example.com/",
+			record: Record{
+				To:   "https://example.test",
+				Code: 302,
+			},
+			location: "https://example.test",
+		},
+		{
+			url: "https://example.com/",
+			record: Record{
+				To:     "https://example.test",
+				Code:   302,
+				AltSvc: `h3=":443"`,
+			},
+			location: "https://example.test",
+			headers: map[string]string{
+				"Alt-Svc": `h3=":443"`,
+			},
+		},
+		{
+			url: "https://example.com/",
+			record: Record{
+				To:           "https://example.test/docs",
+				Code:         302,
+				RootRedirect: "https://home.example.test",
+			},
+			location: "https://home.example.test",
+		},
+		{
+			url: "https://example.com/deep/path",
+			record: Record{
+				To:           "https://example.test/docs",
+				Code:         302,
+				RootRedirect: "https://home.example.test",
+			},
+			location: "https://example.test/docs",
+		},
+		{
+			url: "https://example.com/",
+			record: Record{
+				To:      "https://example.test",
+				Code:    302,
+				Refresh: &refresh,
+			},
+			location: "https://example.test",
+			headers: map[string]string{
+				"Refresh": "5; url=https://example.test",
+			},
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		req = test.record.addToContext(req)
+
+		if err := NewHost(resp, req, test.record, Config{}).Redirect(); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if resp.Code != test.record.Code {
+			t.Errorf("Test %d: Expected status code %d, got %d", i, test.record.Code, resp.Code)
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+		for header, value := range test.headers {
+			if got := resp.Header().Get(header); got != value {
+				t.Errorf("Test %d: Expected %s header to be '%s', got '%s'", i, header, value, got)
+			}
+		}
+	}
+}
+
+func TestHostRedirectReason(t *testing.T) {
+	rec := Record{
+		To:     "https://example.test/new",
+		Code:   http.StatusFound,
+		Reason: "Moved to new home",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := rec.addToContext(r)
+		NewHost(w, req, rec, Config{}).Redirect()
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Status != "302 Moved to new home" {
+		t.Errorf("Expected the status line to be '302 Moved to new home', got '%s'", resp.Status)
+	}
+	if location := resp.Header.Get("Location"); location != rec.To {
+		t.Errorf("Expected location to be %s, got %s", rec.To, location)
+	}
+}
+
+func TestRedirectReasonWrappers(t *testing.T) {
+	events := make(chan RedirectEvent, 1)
+	c := Config{
+		Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+		Enable:       []string{"host"},
+		ServerTiming: true,
+		DebugHeaders: true,
+		OnRedirect: func(e RedirectEvent) {
+			events <- e
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Host = "reason.host.example.com"
+		Redirect(w, r, c)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Status != "302 Moved to new home" {
+		t.Errorf("Expected the status line to be '302 Moved to new home', got '%s'", resp.Status)
+	}
+	if resp.Header.Get("Server-Timing") == "" {
+		t.Errorf("Expected the Server-Timing header to be set")
+	}
+	if chain := resp.Header.Get("X-TXTDirect-Chain"); chain != "_redirect.reason.host.example.com;type=host" {
+		t.Errorf("Unexpected X-TXTDirect-Chain header: %s", chain)
+	}
+	select {
+	case e := <-events:
+		if e.Code != http.StatusFound || e.Target != "https://reason.host.test" {
+			t.Errorf("Unexpected redirect event: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected OnRedirect to be called")
+	}
+}
+
+func TestRedirectReasonWithoutHijack(t *testing.T) {
+	c := Config{
+		Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+		Enable:       []string{"host"},
+		ServerTiming: true,
+	}
+	// The recorder can't be hijacked, but the hookWriter around it
+	// still has a Hijack method
+	req := httptest.NewRequest("GET", "https://reason.host.example.com/", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if resp.Code != http.StatusFound {
+		t.Errorf("Expected the status code to be %d, got %d", http.StatusFound, resp.Code)
+	}
+	if location := resp.Header().Get("Location"); location != "https://reason.host.test" {
+		t.Errorf("Expected location to be https://reason.host.test, got %s", location)
+	}
+	if connection := resp.Header().Get("Connection"); connection != "" {
+		t.Errorf("Expected no Connection header, got %s", connection)
+	}
+	if length := resp.Header().Get("Content-Length"); length == "0" && resp.Body.Len() != 0 {
+		t.Errorf("Expected the Content-Length header to match the %d bytes body", resp.Body.Len())
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Hours is a daily time window in a specific location
+// e.g. "09:00-17:00/America/New_York"
+type Hours struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// parseHours parses the given "HH:MM-HH:MM/Timezone" time window.
+// The timezone is optional and defaults to UTC.
+func parseHours(s string) (*Hours, error) {
+	h := &Hours{Location: time.UTC}
+
+	window := s
+	if i := strings.Index(s, "/"); i != -1 {
+		window = s[:i]
+		loc, err := time.LoadLocation(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %s", s[i+1:])
+		}
+		h.Location = loc
+	}
+
+	times := strings.Split(window, "-")
+	if len(times) != 2 {
+		return nil, fmt.Errorf("time window %s should be in HH:MM-HH:MM format", window)
+	}
+	for i, dst := range []*time.Duration{&h.Start, &h.End} {
+		t, err := time.Parse("15:04", times[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %s", times[i])
+		}
+		*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return h, nil
+}
+
+// Contains checks if the given time is inside the window. Windows that end
+// before they start like "22:00-06:00" span over midnight.
+func (h *Hours) Contains(t time.Time) bool {
+	t = t.In(h.Location)
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if h.Start <= h.End {
+		return d >= h.Start && d < h.End
+	}
+	return d >= h.Start || d < h.End
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageRange is a language range from an Accept-Language header
+// with its quality value
+type languageRange struct {
+	tag string
+	q   float64
+}
+
+// parseAcceptLanguage returns the language ranges of an Accept-Language
+// header ordered by their quality values. The ranges with a zero or
+// invalid q-value are skipped.
+func parseAcceptLanguage(header string) []languageRange {
+	var ranges []languageRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(params[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		if q == 0 {
+			continue
+		}
+		ranges = append(ranges, languageRange{tag: tag, q: q})
+	}
+	// Ranges with the same q-value keep the header's order
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+// languageTarget returns the lang.<tag>= target that best matches the
+// request's Accept-Language header. A range matches the tags that are
+// equal to it or start with it followed by "-", e.g. "fr" matches
+// lang.fr-ca= if the record doesn't have lang.fr=, and "fr-ca" matches
+// lang.fr=. The "*" range is left to the to= target.
+func (rec Record) languageTarget(r *http.Request) (string, bool) {
+	if len(rec.Languages) == 0 {
+		return "", false
+	}
+	for _, lang := range parseAcceptLanguage(r.Header.Get("Accept-Language")) {
+		if lang.tag == "*" {
+			return "", false
+		}
+		if to, ok := rec.Languages[lang.tag]; ok {
+			return to, true
+		}
+		// Fall back to the primary language of the range
+		if i := strings.Index(lang.tag, "-"); i != -1 {
+			if to, ok := rec.Languages[lang.tag[:i]]; ok {
+				return to, true
+			}
+		}
+		// Or to a more specific tag of the same language
+		tags := make([]string, 0, len(rec.Languages))
+		for tag := range rec.Languages {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, lang.tag+"-") {
+				return rec.Languages[tag], true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseRecordLanguages(t *testing.T) {
+	tests := []struct {
+		txtRecord string
+		languages map[string]string
+		err       bool
+	}{
+		{
+			txtRecord: "v=txtv0;to=https://example.test;lang.fr=https://fr.example.test",
+			languages: map[string]string{"fr": "https://fr.example.test"},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.test;lang.FR=https://fr.example.test/?x=1;scheme=http;query=drop",
+			languages: map[string]string{"fr": "http://fr.example.test/"},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.test;lang.fr=https://fr.example.test/%zz",
+			err:       true,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.test;lang.=https://fr.example.test",
+			err:       true,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		rec, err := ParseRecord(test.txtRecord, httptest.NewRecorder(), req, Config{Enable: []string{"host"}})
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(rec.Languages, test.languages) {
+			t.Errorf("Test %d: Expected the languages %v, got %v", i, test.languages, rec.Languages)
+		}
+	}
+}
+
+func Test_parseAcceptLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []languageRange
+	}{
+		{
+			header: "",
+		},
+		{
+			header:   "fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5",
+			expected: []languageRange{{"fr-ch", 1}, {"fr", 0.9}, {"en", 0.8}, {"de", 0.7}, {"*", 0.5}},
+		},
+		{
+			header:   "en;q=0.5, fr",
+			expected: []languageRange{{"fr", 1}, {"en", 0.5}},
+		},
+		{
+			header:   "en;q=0, de;q=2, fr;q=0.3",
+			expected: []languageRange{{"fr", 0.3}},
+		},
+	}
+	for i, test := range tests {
+		if got := parseAcceptLanguage(test.header); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, got)
+		}
+	}
+}
+
+func TestRedirectLanguage(t *testing.T) {
+	tests := []struct {
+		language string
+		location string
+	}{
+		{
+			language: "fr-FR, fr;q=0.9, en;q=0.8",
+			location: "https://fr.example.test",
+		},
+		{
+			language: "en-US, en;q=0.9",
+			location: "https://example.test",
+		},
+		{
+			language: "",
+			location: "https://example.test",
+		},
+		{
+			language: "de;q=0.9, pt;q=0.8",
+			location: "https://br.example.test",
+		},
+		{
+			language: "*, fr;q=0.5",
+			location: "https://example.test",
+		},
+		{
+			language: "fr;q=0",
+			location: "https://example.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://lang.host.example.com/", nil)
+		if test.language != "" {
+			req.Header.Set("Accept-Language", test.language)
+		}
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+		if vary := resp.Header().Get("Vary"); vary != "Accept-Language" {
+			t.Errorf("Test %d: Expected the Vary header to be Accept-Language, got %s", i, vary)
+		}
+	}
+}
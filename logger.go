@@ -0,0 +1,158 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logger is used for all of the package's logs. Its output is set
+// based on Config.LogOutput with SetLogOutput.
+var logger = log.New(os.Stderr, "", log.LstdFlags)
+
+// logMu guards logFile and serializes the JSON log lines
+var logMu sync.Mutex
+
+// logFile is the log file opened for the current LogOutput, if any
+var logFile io.Closer
+
+// SetLogOutput sets the destination of the logs. It can be "stdout",
+// "stderr", "null" or "" to discard the logs, or the path of a file the
+// logs are appended to. The file is rotated after 100 MB. It returns an
+// error if the file can't be opened and keeps the current output then.
+func SetLogOutput(output string) error {
+	var w io.Writer
+	// Only the log files are closed, not stdout and stderr
+	var file io.Closer
+	switch output {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	case "", "null":
+		w = ioutil.Discard
+	default:
+		// lumberjack only opens the file on the first write
+		f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("could not open the log file: %s", err)
+		}
+		f.Close()
+		l := &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    100,
+			MaxAge:     14,
+			MaxBackups: 10,
+		}
+		w, file = l, l
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logFile != nil {
+		logFile.Close()
+	}
+	logFile = file
+	logger.SetOutput(w)
+	return nil
+}
+
+// CloseLogOutput closes the log file opened for LogOutput. It's meant
+// to be called on shutdown.
+func CloseLogOutput() error {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logFile == nil {
+		return nil
+	}
+	err := logFile.Close()
+	logFile = nil
+	return err
+}
+
+// logEntry is a single JSON log line with the details of the request
+type logEntry struct {
+	Time           string `json:"time"`
+	Msg            string `json:"msg"`
+	Host           string `json:"host,omitempty"`
+	Path           string `json:"path,omitempty"`
+	Type           string `json:"type,omitempty"`
+	Target         string `json:"target,omitempty"`
+	Status         int    `json:"status,omitempty"`
+	FallbackReason string `json:"fallback_reason,omitempty"`
+}
+
+// logf logs a message about the given request in the format set by
+// Config.LogFormat. Both formats are written to the logger's output,
+// which is set based on Config.LogOutput.
+func logf(c Config, r *http.Request, format string, args ...interface{}) {
+	if c.LogFormat != "json" {
+		logger.Printf("[txtdirect]: "+format, args...)
+		return
+	}
+	writeLogEntry(r, logEntry{Msg: fmt.Sprintf(format, args...)})
+}
+
+// logFallback logs the reason of the fallback triggered for the request
+func logFallback(c Config, r *http.Request, recordType, reason string, args ...interface{}) {
+	if c.LogFormat != "json" {
+		logger.Printf("[txtdirect]: Fallback is triggered because "+reason, args...)
+		return
+	}
+	writeLogEntry(r, logEntry{
+		Msg:            "fallback is triggered",
+		Type:           recordType,
+		FallbackReason: fmt.Sprintf(reason, args...),
+	})
+}
+
+// logRedirect logs the target the request is redirected to
+func logRedirect(c Config, r *http.Request, recordType, target string, status int) {
+	if c.LogFormat != "json" {
+		logger.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, target)
+		return
+	}
+	writeLogEntry(r, logEntry{
+		Msg:    "redirect",
+		Type:   recordType,
+		Target: target,
+		Status: status,
+	})
+}
+
+func writeLogEntry(r *http.Request, entry logEntry) {
+	entry.Time = time.Now().UTC().Format(time.RFC3339)
+	entry.Host = r.Host
+	entry.Path = r.URL.Path
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		logger.Printf("[txtdirect]: Couldn't encode the log entry: %s", err)
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	logger.Writer().Write(append(b, '\n'))
+}
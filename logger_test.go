@@ -0,0 +1,127 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRedirectLogFormat(t *testing.T) {
+	var buf bytes.Buffer
+	output := logger.Writer()
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(output)
+
+	redirect := func(host, format string) {
+		buf.Reset()
+		req := httptest.NewRequest("GET", "https://"+host+"/docs", nil)
+		c := Config{
+			Resolver:  "127.0.0.1:" + strconv.Itoa(port),
+			Enable:    []string{"host"},
+			Redirect:  "https://fallback.test",
+			LogFormat: format,
+		}
+		if err := Redirect(httptest.NewRecorder(), req, c); err != nil {
+			t.Fatalf("Unexpected error occured: %s", err.Error())
+		}
+	}
+
+	redirect("flag.host.example.com", "")
+	if !strings.Contains(buf.String(), "[txtdirect]: Fallback is triggered because the new-checkout flag is off") {
+		t.Errorf("Expected the text logs by default, got %s", buf.String())
+	}
+
+	redirect("flag.host.example.com", "json")
+	var entries []logEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		// The parser's warnings aren't request logs
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var entry logEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected a JSON log line, got %s", line)
+		}
+		entries = append(entries, entry)
+	}
+
+	expected := []logEntry{
+		{
+			Msg:            "fallback is triggered",
+			Host:           "flag.host.example.com",
+			Path:           "/docs",
+			Type:           "host",
+			FallbackReason: "the new-checkout flag is off",
+		},
+		{
+			Msg:    "redirect",
+			Host:   "flag.host.example.com",
+			Path:   "/docs",
+			Target: "https://fallback.test",
+			Status: 301,
+		},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d log entries, got %d: %s", len(expected), len(entries), buf.String())
+	}
+	for i, entry := range entries {
+		if entry.Time == "" {
+			t.Errorf("Entry %d: Expected the time to be set", i)
+		}
+		entry.Time = ""
+		if entry != expected[i] {
+			t.Errorf("Entry %d: Expected %+v, got %+v", i, expected[i], entry)
+		}
+	}
+}
+
+func TestSetLogOutput(t *testing.T) {
+	output := logger.Writer()
+	defer logger.SetOutput(output)
+
+	if err := SetLogOutput("null"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if logger.Writer() != ioutil.Discard {
+		t.Errorf("Expected the logs to be discarded for null")
+	}
+	if err := SetLogOutput("stdout"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if logger.Writer() != os.Stdout {
+		t.Errorf("Expected the logs to be written to stdout")
+	}
+
+	// The current output is kept if the log file can't be opened
+	if err := SetLogOutput(filepath.Join(os.DevNull, "txtdirect.log")); err == nil {
+		t.Errorf("Expected an error for a log file that can't be opened")
+	}
+	if logger.Writer() != os.Stdout {
+		t.Errorf("Expected the logs to still be written to stdout")
+	}
+	if err := CloseLogOutput(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if _, err := os.Stdout.Stat(); err != nil {
+		t.Errorf("Expected stdout to be left open, got %s", err)
+	}
+}
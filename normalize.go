@@ -0,0 +1,76 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// hostNormalizationSteps are the steps allowed in HostNormalization
+var hostNormalizationSteps = []string{"lowercase", "strip_port", "strip_trailing_dot", "punycode"}
+
+// validateHostNormalization checks that the given HostNormalization
+// steps are known
+func validateHostNormalization(steps []string) error {
+	for _, step := range steps {
+		if !contains(hostNormalizationSteps, step) {
+			return fmt.Errorf("unknown host normalization step %s", step)
+		}
+	}
+	return nil
+}
+
+// normalizeHost applies the normalization steps from the config's
+// HostNormalization to the given host in order. Fully qualified hosts
+// like "example.com." would end up in the zone with an extra dot, so
+// the trailing dot is always removed first and the "strip_trailing_dot"
+// step is only kept for the existing configs.
+func normalizeHost(host string, c Config) string {
+	host = trimTrailingDot(host)
+	for _, step := range c.HostNormalization {
+		switch step {
+		case "lowercase":
+			host = strings.ToLower(host)
+		case "strip_port":
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+		case "punycode":
+			host = punycode(host)
+		}
+	}
+	return host
+}
+
+// punycode converts the internationalized labels of the given host to
+// their ASCII form while keeping the port intact. The host is returned
+// as it is if it can't be converted.
+func punycode(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		h, port = host, ""
+	}
+	ascii, err := idna.Lookup.ToASCII(h)
+	if err != nil {
+		return host
+	}
+	if port != "" {
+		return net.JoinHostPort(ascii, port)
+	}
+	return ascii
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func Test_normalizeHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		steps    []string
+		expected string
+	}{
+		{"Example.com.:8080", nil, "Example.com:8080"},
+		{"Example.COM", []string{"lowercase"}, "example.com"},
+		{"example.com:8080", []string{"strip_port"}, "example.com"},
+		{"[2001:db8::1]:443", []string{"strip_port"}, "2001:db8::1"},
+		{"example.com.", []string{"strip_trailing_dot"}, "example.com"},
+		{"bücher.example", []string{"punycode"}, "xn--bcher-kva.example"},
+		{"bücher.example:8080", []string{"punycode"}, "xn--bcher-kva.example:8080"},
+		{"Bücher.Example.:8080", []string{"lowercase", "strip_port", "strip_trailing_dot", "punycode"}, "xn--bcher-kva.example"},
+		{"Example.com.", []string{}, "Example.com"},
+		{"Example.com.:8080", []string{"lowercase"}, "example.com:8080"},
+	}
+	for i, test := range tests {
+		c := Config{HostNormalization: test.steps}
+		if result := normalizeHost(test.host, c); result != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, result)
+		}
+	}
+}
+
+func Test_validateHostNormalization(t *testing.T) {
+	if err := validateHostNormalization([]string{"lowercase", "strip_port", "strip_trailing_dot", "punycode"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if err := validateHostNormalization([]string{"lowercase", "strip_dot"}); err == nil {
+		t.Errorf("Expected an error for an unknown step")
+	}
+}
+
+func TestRedirectHostNormalization(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://Host.Host.Example.com.:8443/", nil)
+	resp := httptest.NewRecorder()
+	c := Config{
+		Resolver:          "127.0.0.1:" + strconv.Itoa(port),
+		Enable:            []string{"host"},
+		HostNormalization: []string{"lowercase", "strip_port", "strip_trailing_dot"},
+	}
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error occured: %s", err.Error())
+	}
+	if location := resp.Header().Get("Location"); location != "https://plain.host.test" {
+		t.Errorf("Expected the normalized host's record to be used, got %s", location)
+	}
+}
@@ -16,13 +16,13 @@ package txtdirect
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -56,6 +56,10 @@ var GroupRegex = regexp.MustCompile("P<[a-zA-Z]+[a-zA-Z0-9]*>")
 // GroupOrderRegex finds the order of regex groups inside re=
 var GroupOrderRegex = regexp.MustCompile("P<([a-zA-Z]+[a-zA-Z0-9]*)>")
 
+// CaptureGroupRegex finds the regex capture group placeholders like $1 inside to=.
+// The ${1} form isn't supported since {1} is the numbered path placeholder.
+var CaptureGroupRegex = regexp.MustCompile(`\$(\d+)`)
+
 // NewPath returns an instance of Path struct using the given data
 func NewPath(w http.ResponseWriter, r *http.Request, path string, rec Record, c Config) *Path {
 	return &Path{
@@ -70,19 +74,19 @@ func NewPath(w http.ResponseWriter, r *http.Request, path string, rec Record, c
 // Redirect finds and returns the final record
 func (p *Path) Redirect() *Record {
 	zone, from, pathSlice, err := zoneFromPath(p.req, p.rec)
+	p.prefetch(zone)
 	rec, err := getFinalRecord(zone, from, p.c, p.rw, p.req, pathSlice)
 	*p.req = *rec.addToContext(p.req)
 	if err != nil {
-		log.Print("Fallback is triggered because an error has occurred: ", err)
+		logFallback(p.c, p.req, p.rec.Type, "an error has occurred: %s", err)
 		fallback(p.rw, p.req, "to", p.rec.Code, p.c)
 		return nil
 	}
 
 	if rec.Type == "path" {
 		if last := p.lastPathRecord(); last != nil && reflect.DeepEqual(rec, *last) {
-			if rec.Code == http.StatusMovedPermanently {
-				p.rw.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", Status301CacheAge))
-			}
+			rec.addCacheControl(p.rw, rec.Code)
+			rec.addRefresh(p.rw, rec.To)
 			http.Redirect(p.rw, p.req, rec.To, rec.Code)
 			return nil
 		}
@@ -93,6 +97,107 @@ func (p *Path) Redirect() *Record {
 	return &rec
 }
 
+// prefetchConcurrency caps the prefetch= lookups running at once.
+// The hints that don't fit are skipped, not queued.
+const prefetchConcurrency = 10
+
+// prefetchTimeout is the timeout of each prefetch= lookup
+const prefetchTimeout = 5 * time.Second
+
+// prefetchNegativeTTL is how long a prefetch= zone that couldn't be
+// resolved isn't looked up again
+const prefetchNegativeTTL = time.Minute
+
+// maxPrefetchFailures caps the number of failed prefetch= zones kept
+const maxPrefetchFailures = 1000
+
+// prefetches keeps the prefetch= lookups of all the requests
+var prefetches = &prefetcher{}
+
+// prefetcher runs the prefetch= lookups in the background. It keeps
+// the zones being looked up so each one is only queried once at a time
+// and the zones that failed recently so they aren't queried on every
+// request.
+type prefetcher struct {
+	mu       sync.Mutex
+	inflight map[string]bool
+	failed   map[string]time.Time
+}
+
+// prefetch starts the lookups of the zones of the record's prefetch=
+// paths to warm up the cache for the likely next hops. It doesn't wait
+// for the lookups and only runs with CacheEnable, since the results
+// would be dropped otherwise.
+func (p *Path) prefetch(zone string) {
+	if !p.c.CacheEnable {
+		return
+	}
+	for _, path := range p.rec.Prefetch {
+		hint := prefetchZone(path, UpstreamZone(p.req))
+		if hint == zone {
+			continue
+		}
+		if _, ok := cache.get(absoluteZone(hint)); ok {
+			continue
+		}
+		prefetches.start(hint, p.c)
+	}
+}
+
+// start looks up the given zone in the background unless it's being
+// looked up already, it failed recently or too many lookups are running
+func (pf *prefetcher) start(zone string, c Config) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.inflight == nil {
+		pf.inflight = make(map[string]bool)
+		pf.failed = make(map[string]time.Time)
+	}
+	if pf.inflight[zone] || now().Before(pf.failed[zone]) || len(pf.inflight) >= prefetchConcurrency {
+		return
+	}
+	pf.inflight[zone] = true
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+		defer cancel()
+		_, err := queryTXT(zone, ctx, c)
+
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+		delete(pf.inflight, zone)
+		if err == nil {
+			delete(pf.failed, zone)
+			return
+		}
+		if len(pf.failed) >= maxPrefetchFailures {
+			for failed, expires := range pf.failed {
+				if !now().Before(expires) {
+					delete(pf.failed, failed)
+				}
+			}
+		}
+		if len(pf.failed) < maxPrefetchFailures {
+			pf.failed[zone] = now().Add(prefetchNegativeTTL)
+		}
+	}()
+}
+
+// prefetchZone generates the DNS zone of the given prefetch= path
+// the same way zoneFromPath does for a request's path
+func prefetchZone(path, host string) string {
+	pathSlice := []string{}
+	for _, v := range PathRegex.FindAllStringSubmatch(path, -1) {
+		pathSlice = append(pathSlice, v[1])
+	}
+	pathSlice = normalize(pathSlice)
+	reverse(pathSlice)
+	url := append(pathSlice, host)
+	url = append([]string{basezone}, url...)
+	return strings.Join(url, ".")
+}
+
 // RedirectRoot redirects the request to record's root= field
 // if the path is empty or "/". If the root= field is empty too
 // fallback will be triggered.
@@ -101,15 +206,44 @@ func (p *Path) RedirectRoot() error {
 		fallback(p.rw, p.req, "to", p.rec.Code, p.c)
 		return nil
 	}
-	log.Printf("[txtdirect]: %s > %s", UpstreamZone(p.req)+p.req.URL.Path, p.rec.Root)
-	if p.rec.Code == http.StatusMovedPermanently {
-		p.rw.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", Status301CacheAge))
-	}
+	logRedirect(p.c, p.req, p.rec.Type, p.rec.Root, p.rec.Code)
+	p.rec.addCacheControl(p.rw, p.rec.Code)
+	p.rec.addRefresh(p.rw, p.rec.Root)
 	p.rw.Header().Add("Status-Code", strconv.Itoa(p.rec.Code))
 	http.Redirect(p.rw, p.req, p.rec.Root, p.rec.Code)
 	return nil
 }
 
+// RedirectRegex redirects the request to the record's to= target with the
+// $1, $2, ... placeholders replaced by the re= regex's capture groups.
+// Fallback is triggered if the regex doesn't match the request's path.
+func (p *Path) RedirectRegex() error {
+	path := p.path
+	if strings.Contains(p.rec.Re, "?query") {
+		path = fmt.Sprintf("%s?%s", path, p.req.URL.RawQuery)
+	}
+	match := p.rec.Regexp.FindStringSubmatchIndex(path)
+	if match == nil {
+		logFallback(p.c, p.req, p.rec.Type, "re= doesn't match %s", path)
+		fallback(p.rw, p.req, "global", http.StatusFound, p.c)
+		return nil
+	}
+	to := string(p.rec.Regexp.ExpandString(nil, p.rec.To, path, match))
+
+	logRedirect(p.c, p.req, p.rec.Type, to, p.rec.Code)
+	p.rec.addCacheControl(p.rw, p.rec.Code)
+	p.rec.addRefresh(p.rw, to)
+	p.rw.Header().Add("Status-Code", strconv.Itoa(p.rec.Code))
+	http.Redirect(p.rw, p.req, to, p.rec.Code)
+	return nil
+}
+
+// hasCaptureGroups checks if the given target uses the
+// $1, $2, ... placeholders of a regex rewrite
+func hasCaptureGroups(target string) bool {
+	return CaptureGroupRegex.MatchString(target)
+}
+
 // SpecificRecord finds the most specific match using the custom regexes from subzones
 // It goes through all the custom regexes specified in each subzone and uses the
 // most specific match to return the final record.
@@ -214,10 +348,14 @@ func zoneFromPath(r *http.Request, rec Record) (string, int, []string, error) {
 
 	// Use the custom regex to parse request's path
 	if rec.Re != "" {
-		// Compile the record regex and find path submatches
-		CustomRegex, err := regexp.Compile(rec.Re)
-		if err != nil {
-			log.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
+		// Records from ParseRecord have the regex compiled already
+		CustomRegex := rec.Regexp
+		if CustomRegex == nil {
+			var err error
+			if CustomRegex, err = regexp.Compile(rec.Re); err != nil {
+				logger.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
+				return "", 0, []string{}, fmt.Errorf("could not compile re= regex: %s", err)
+			}
 		}
 		pathSubmatchs = CustomRegex.FindAllStringSubmatch(path, -1)
 
@@ -315,6 +453,7 @@ func getFinalRecord(zone string, from int, c Config, w http.ResponseWriter, r *h
 	if rec, err = ParseRecord(txts[0], w, r, c); err != nil {
 		return rec, fmt.Errorf("could not parse record: %s", err)
 	}
+	trackRecord(r.Context(), zone, rec)
 
 	if rec.Type == "path" {
 		records := r.Context().Value("records").([]Record)
@@ -16,7 +16,13 @@ package txtdirect
 import (
 	"fmt"
 	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 func Test_zoneFromPath(t *testing.T) {
@@ -247,3 +253,187 @@ func Test_zoneFromPathRegexPlaceholders(t *testing.T) {
 		}
 	}
 }
+
+func TestPathRedirectRegex(t *testing.T) {
+	tests := []struct {
+		url      string
+		location string
+	}{
+		{
+			url:      "https://rewrite.path.example.com/docs/guide/2",
+			location: "https://docs.test/v2/guide",
+		},
+		{
+			url:      "https://rewrite.path.example.com/blog/guide/2",
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"path"},
+			Redirect: "https://fallback.test",
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+
+	for target, expected := range map[string]bool{
+		"https://docs.test/$1/guide": true,
+		"https://docs.test/$12":      true,
+		// {1} is the numbered path placeholder, parsed before the rewrite
+		"https://docs.test/${1}/guide": false,
+		"https://docs.test/$":          false,
+	} {
+		if hasCaptureGroups(target) != expected {
+			t.Errorf("Expected hasCaptureGroups(%s) to be %t", target, expected)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	if _, err := ParseRecord("v=txtv0;type=path;re=^/docs/([a-z+;to=https://docs.test/$1", httptest.NewRecorder(), req, Config{}); err == nil {
+		t.Errorf("Expected an error for an invalid re= regex")
+	}
+}
+
+func TestPathPrefetch(t *testing.T) {
+	cache.reset()
+	t.Cleanup(cache.reset)
+
+	addr := startDNSServer(t, "udp", txtHandler(map[string]string{
+		"_redirect.prefetch.example.com.":          "v=txtv0;type=path;prefetch=/docs;prefetch=/api/v1.2",
+		"_redirect.blog.prefetch.example.com.":     "v=txtv0;to=https://blog.test",
+		"_redirect.docs.prefetch.example.com.":     "v=txtv0;to=https://docs.test",
+		"_redirect.v1-2.api.prefetch.example.com.": "v=txtv0;to=https://api.test",
+	}))
+	c := Config{
+		Resolver:    addr,
+		Enable:      []string{"path", "host"},
+		CacheEnable: true,
+	}
+
+	req := httptest.NewRequest("GET", "https://prefetch.example.com/blog", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://blog.test" {
+		t.Errorf("Expected location to be https://blog.test, got %s", location)
+	}
+
+	// The prefetch doesn't block the redirect
+	for _, zone := range []string{"docs.prefetch.example.com", "v1-2.api.prefetch.example.com"} {
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, ok := cache.get(absoluteZone(zone)); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("Expected %s to be prefetched into the cache", zone)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if _, err := ParseRecord("v=txtv0;type=path;prefetch=docs", httptest.NewRecorder(), req, Config{}); err == nil {
+		t.Errorf("Expected an error for a prefetch= value that isn't a path")
+	}
+}
+
+func TestPathPrefetchLimits(t *testing.T) {
+	cache.reset()
+	t.Cleanup(cache.reset)
+	prefetches = &prefetcher{}
+	t.Cleanup(func() { prefetches = &prefetcher{} })
+
+	current := time.Now()
+	var mu sync.Mutex
+	now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return current
+	}
+	t.Cleanup(func() { now = time.Now })
+
+	release := make(chan struct{})
+	var queries int32
+	records := txtHandler(map[string]string{
+		"_redirect.prefetch.example.com.":      "v=txtv0;type=path;prefetch=/missing",
+		"_redirect.blog.prefetch.example.com.": "v=txtv0;to=https://blog.test",
+	})
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name != "_redirect.missing.prefetch.example.com." {
+			records(w, r)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		<-release
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	c := Config{
+		Resolver:    addr,
+		Enable:      []string{"path", "host"},
+		CacheEnable: true,
+	}
+
+	redirect := func() {
+		req := httptest.NewRequest("GET", "https://prefetch.example.com/blog", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != "https://blog.test" {
+			t.Errorf("Expected location to be https://blog.test, got %s", location)
+		}
+	}
+	waitPrefetches := func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			prefetches.mu.Lock()
+			inflight := len(prefetches.inflight)
+			prefetches.mu.Unlock()
+			if inflight == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the prefetches to finish")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The hint that's being looked up isn't queried again
+	for i := 0; i < 3; i++ {
+		redirect()
+	}
+	close(release)
+	waitPrefetches()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected the in-flight hint to be queried once, got %d queries", n)
+	}
+
+	// The hint that doesn't exist isn't queried again for a while
+	redirect()
+	waitPrefetches()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("Expected the missing hint not to be queried again, got %d queries", n)
+	}
+
+	mu.Lock()
+	current = current.Add(prefetchNegativeTTL + time.Second)
+	mu.Unlock()
+	redirect()
+	waitPrefetches()
+	if n := atomic.LoadInt32(&queries); n != 2 {
+		t.Errorf("Expected the missing hint to be queried again after %s, got %d queries", prefetchNegativeTTL, n)
+	}
+}
@@ -15,28 +15,59 @@ package txtdirect
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Record struct {
-	Version string
-	To      string
-	Code    int
-	Type    string
-	Use     []string
-	Vcs     string
-	Website string
-	From    string
-	Root    string
-	Re      string
-	Ref     bool
-	Headers map[string]string
+	Version           string
+	To                string
+	Targets           []WeightedTarget
+	AfterHoursTo      string
+	Code              int
+	Type              string
+	Use               []string
+	Vcs               string
+	Website           string
+	Family            int
+	Flag              string
+	From              string
+	FromScheme        string
+	Root              string
+	Re                string
+	Regexp            *regexp.Regexp
+	Reason            string
+	Ref               bool
+	Referer           string
+	Compress          int
+	CORP              string
+	AltSvc            string
+	ClearSiteData     []string
+	Robots            string
+	Nonce             bool
+	PermissionsPolicy string
+	DocumentPolicy    string
+	FrameOptions      string
+	Query             string
+	Preconnect        []string
+	Prefetch          []string
+	RootRedirect      string
+	Scheme            string
+	Sunset            time.Time
+	Hours             *Hours
+	MaxAge            *int
+	Refresh           *int
+	TTL               uint32
+	Headers           map[string]string
+	Languages         map[string]string
 }
 
 // GetRecord uses the given host to find a TXT record
@@ -44,187 +75,826 @@ type Record struct {
 // struct instance. It returns an error when it can't find any txt
 // records or if the TXT record is not standard.
 func GetRecord(host string, c Config, w http.ResponseWriter, r *http.Request) (Record, error) {
-	txts, err := query(host, r.Context(), c)
+	host = normalizeHost(host, c)
+	strategies, err := lookupStrategies(c)
 	if err != nil {
-		log.Printf("Initial DNS query failed: %s", err)
+		return Record{}, err
 	}
 
-	// If record isn't on apex zone, check the "_" subzone
-	if err != nil && r.Context().Value("records") == nil {
-		txts, err = query(fmt.Sprintf("_.%s", host), r.Context(), c)
-		if err != nil {
-			log.Printf("Apex zone's wildcard DNS query failed: %s", err)
+	var res txtResult
+	zone := host
+	for i, strategy := range strategies {
+		// The "_" subzone is only checked for the request's own host,
+		// not for the upstream and path records
+		if strategy.name == "subzone" && r.Context().Value("records") != nil {
+			continue
 		}
-	}
-
-	// if error present or record empty, jump into wildcards
-	if err != nil || txts[0] == "" {
-		hostSlice := strings.Split(host, ".")
-		hostSlice[0] = "_"
-		host = strings.Join(hostSlice, ".")
-		txts, err = query(host, r.Context(), c)
-		if err != nil {
-			log.Printf("Wildcard DNS query failed: %s", err.Error())
-			return Record{}, err
+		zone = strategy.zone(host)
+		if res, err = queryTXT(zone, r.Context(), c); err == nil {
+			if i != 0 {
+				logf(c, r, "Record of %s found by the %s lookup of %s", host, strategy.name, zone)
+			}
+			break
 		}
+		logf(c, r, "The %s lookup of %s failed: %s", strategy.name, zone, err)
+	}
+	if err != nil {
+		return Record{}, err
 	}
 
-	if len(txts) != 1 {
-		return Record{}, fmt.Errorf("could not parse TXT record with %d records", len(txts))
+	txt := res.Txts[0]
+	if c.ShuffleAnswers && len(res.Txts) > 1 {
+		txt = shuffleAnswers(res.Txts)
+	} else if len(res.Txts) != 1 {
+		return Record{}, fmt.Errorf("could not parse TXT record with %d records", len(res.Txts))
 	}
 
 	var rec Record
-	if rec, err = ParseRecord(txts[0], w, r, c); err != nil {
-		return rec, fmt.Errorf("could not parse record: %s", err)
+	if rec, err = ParseRecord(txt, w, r, c); err != nil {
+		return rec, fmt.Errorf("could not parse record: %w", err)
 	}
+	rec.TTL = res.TTL
+	trackRecord(r.Context(), zone, rec)
 
 	r = rec.addToContext(r)
 
 	// Add the headers from record to the response
-	if len(rec.Headers) != 0 {
-		for header, val := range rec.Headers {
-			w.Header().Set(header, val)
-		}
-	}
+	rec.addHeaders(w)
 
 	return rec, nil
 }
 
+// lookupStrategy is one of the zones queried by GetRecord for a host
+type lookupStrategy struct {
+	name string
+	zone func(host string) string
+}
+
+var (
+	// apexLookup queries the host itself
+	apexLookup = lookupStrategy{"apex", func(host string) string {
+		return host
+	}}
+	// subzoneLookup queries the host's "_" subzone
+	subzoneLookup = lookupStrategy{"subzone", func(host string) string {
+		return "_." + host
+	}}
+	// wildcardLookup replaces the host's first label with "_"
+	wildcardLookup = lookupStrategy{"wildcard", func(host string) string {
+		labels := strings.Split(host, ".")
+		labels[0] = "_"
+		return strings.Join(labels, ".")
+	}}
+)
+
+// lookupStrategies returns the lookups tried in order by GetRecord
+// for the configured WildcardPolicy
+func lookupStrategies(c Config) ([]lookupStrategy, error) {
+	switch c.WildcardPolicy {
+	case "", "specific-first":
+		return []lookupStrategy{apexLookup, subzoneLookup, wildcardLookup}, nil
+	case "apex-first":
+		return []lookupStrategy{apexLookup, wildcardLookup, subzoneLookup}, nil
+	}
+	return nil, fmt.Errorf("unknown wildcard policy %s", c.WildcardPolicy)
+}
+
+// shuffleAnswers picks one of the txtdirect records randomly among the
+// given answers, the other records in the zone like SPF are skipped
+func shuffleAnswers(txts []string) string {
+	return pickAnswer(txts, rand.New(rand.NewSource(now().UnixNano())))
+}
+
+// pickAnswer selects one of the txtdirect records in the given answers
+func pickAnswer(txts []string, rnd *rand.Rand) string {
+	var records []string
+	for _, txt := range txts {
+		if isRecord(splitFields(txt)) {
+			records = append(records, txt)
+		}
+	}
+	if len(records) == 0 {
+		return txts[0]
+	}
+	return records[rnd.Intn(len(records))]
+}
+
+// vcsTypes are the version control systems supported by the
+// go-import meta tag
+var vcsTypes = []string{"git", "hg", "bzr", "svn"}
+
+// ErrMissingTarget is returned by ParseRecord for host records without
+// a to= target
+var ErrMissingTarget = errors.New("to= field is required in host type")
+
 // ParseRecord takes a string containing the DNS TXT record and returns
 // a TXTDirect record struct instance.
 // It will return an error if the DNS TXT record is not standard or
 // if the record type is not enabled in the TXTDirect's config.
+// It doesn't write to w, triggering the fallbacks is up to the caller.
 func ParseRecord(str string, w http.ResponseWriter, req *http.Request, c Config) (Record, error) {
+	defer trackTiming(req.Context(), "parse", time.Now())
+
 	r := Record{
 		Headers: map[string]string{},
 	}
 
-	s := strings.Split(str, ";")
+	s := splitFields(str)
 
-	// Trim whitespace both leading and trailing
-	for i := range s {
-		s[i] = strings.TrimSpace(s[i])
+	// Other records in the same zone, like SPF or domain
+	// verification records, aren't parsed any further
+	if !isRecord(s) {
+		return Record{}, fmt.Errorf("not a txtdirect record")
 	}
 
 	for _, l := range s {
-		switch {
-		case strings.HasPrefix(l, "code="):
-			l = strings.TrimPrefix(l, "code=")
-			i, err := strconv.Atoi(l)
-			if err != nil {
-				return Record{}, fmt.Errorf("could not parse status code: %s", err)
-			}
-			r.Code = i
+		if err := parseField(&r, l, req, c); err != nil {
+			return Record{}, err
+		}
+	}
 
-		case strings.HasPrefix(l, "from="):
-			l = strings.TrimPrefix(l, "from=")
-			l, err := parsePlaceholders(l, req, []string{})
+	if errs := r.missingFields(); len(errs) != 0 {
+		return Record{}, errs[0]
+	}
+
+	// The targets picked at request time, like the to= lists, the
+	// rootredirect= and the lang.<tag>= targets, get the same scheme=
+	// and query= treatment as to=
+	targets := []*string{&r.To, &r.AfterHoursTo, &r.RootRedirect}
+	for i := range r.Targets {
+		targets = append(targets, &r.Targets[i].URL)
+	}
+	for _, target := range targets {
+		if *target == "" {
+			continue
+		}
+		t, err := r.processTarget(*target, req)
+		if err != nil {
+			return Record{}, err
+		}
+		*target = t
+	}
+	for i := range r.Targets {
+		// The health checks follow the scheme= of the targets too
+		if r.Scheme != "" && r.Targets[i].Origin != "" {
+			origin, err := setScheme(r.Targets[i].Origin, r.Scheme)
 			if err != nil {
-				return Record{}, err
+				return Record{}, fmt.Errorf("could not set the target's scheme: %s", err)
 			}
-			r.From = l
+			r.Targets[i].Origin = origin
+		}
+	}
+	for lang, target := range r.Languages {
+		t, err := r.processTarget(target, req)
+		if err != nil {
+			return Record{}, err
+		}
+		r.Languages[lang] = t
+	}
 
-		case strings.HasPrefix(l, "re="):
-			l = strings.TrimPrefix(l, "re=")
-			r.Re = l
+	if r.Query != "" && r.Root != "" {
+		root, err := applyQuery(r.Root, r.Query, req)
+		if err != nil {
+			return Record{}, fmt.Errorf("could not apply the query to the target: %s", err)
+		}
+		r.Root = root
+	}
 
-		case strings.HasPrefix(l, "ref="):
-			l, err := strconv.ParseBool(strings.TrimPrefix(l, "ref="))
-			if err != nil {
-				fallback(w, req, "global", http.StatusMovedPermanently, c)
-				return Record{}, err
-			}
-			r.Ref = l
+	if r.Code == 0 {
+		r.Code = http.StatusFound
+	}
 
-		case strings.HasPrefix(l, "root="):
-			l = strings.TrimPrefix(l, "root=")
-			l, err := parsePlaceholders(l, req, []string{})
-			if err != nil {
-				return Record{}, err
+	// Only apply rules and default to records that doesn't point to a upstream record
+	if len(r.Use) == 0 {
+		if r.Type == "" {
+			r.Type = "host"
+		}
+
+		if r.Type == "host" && r.To == "" {
+			return Record{}, ErrMissingTarget
+		}
+
+		if !contains(c.Enable, r.Type) {
+			return Record{}, fmt.Errorf("%s type is not enabled in configuration", r.Type)
+		}
+	}
+
+	if c.SchemaValidate {
+		if err := r.validateSchema(); err != nil {
+			return Record{}, fmt.Errorf("record doesn't match the schema: %w", err)
+		}
+	}
+
+	return r, nil
+}
+
+// splitFields splits a TXT record into its trimmed fields. The escaped
+// semicolons are kept in the fields, see splitEscaped.
+func splitFields(str string) []string {
+	s := splitEscaped(str, ';')
+
+	// Trim whitespace both leading and trailing
+	for i := range s {
+		s[i] = lowerKey(strings.TrimSpace(s[i]))
+	}
+	return joinWeightedTargets(s)
+}
+
+// splitEscaped splits s on the given separator unless it's escaped with
+// a backslash. The escapes are kept, so the parts can be split again.
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == ';' || s[i+1] == '=') {
+			i++
+			continue
+		}
+		if s[i] == sep {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// escapeReplacer unescapes the "\;" and "\=" in the record values
+var escapeReplacer = strings.NewReplacer(`\;`, ";", `\=`, "=")
+
+// unescape removes the backslashes of the escaped separators in s
+func unescape(s string) string {
+	return escapeReplacer.Replace(s)
+}
+
+// missingFields returns an error for each field that's required by
+// the other fields of the record but isn't set
+func (rec Record) missingFields() []error {
+	var errs []error
+	if rec.Type == "dockerv2" && rec.To == "" {
+		errs = append(errs, fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type"))
+	}
+	if rec.Type == "alias" && rec.To == "" {
+		errs = append(errs, fmt.Errorf("to= field is required in alias type"))
+	}
+	if rec.Hours != nil && rec.AfterHoursTo == "" {
+		errs = append(errs, fmt.Errorf("hours= requires an afterhours.to= target"))
+	}
+	return errs
+}
+
+// parseField parses a single field of a TXT record into the given record
+func parseField(r *Record, l string, req *http.Request, c Config) error {
+	// The fields that are split further use the raw field with the escapes
+	raw := l
+	l = unescape(l)
+
+	switch {
+	case strings.HasPrefix(l, "afterhours.to="):
+		l = strings.TrimPrefix(l, "afterhours.to=")
+		l, err := parsePlaceholders(l, req, []string{})
+		if err != nil {
+			return err
+		}
+		if l, err = parseURI(l); err != nil {
+			return err
+		}
+		r.AfterHoursTo = l
+
+	case strings.HasPrefix(l, "altsvc="):
+		l = strings.TrimPrefix(l, "altsvc=")
+		altsvc, err := url.PathUnescape(l)
+		if err != nil {
+			return err
+		}
+		r.AltSvc = altsvc
+
+	case strings.HasPrefix(l, "clearsitedata="):
+		for _, directive := range strings.Split(strings.TrimPrefix(l, "clearsitedata="), ",") {
+			directive = strings.TrimSpace(directive)
+			if !contains([]string{"cache", "cookies", "storage", "executionContexts", "*"}, directive) {
+				return fmt.Errorf("unsupported clearsitedata value: %s", directive)
 			}
-			l = ParseURI(l, w, req, c)
-			r.Root = l
+			r.ClearSiteData = append(r.ClearSiteData, directive)
+		}
+
+	case strings.HasPrefix(l, "code="):
+		l = strings.TrimPrefix(l, "code=")
+		i, err := strconv.Atoi(l)
+		if err != nil {
+			return fmt.Errorf("could not parse status code: %s", err)
+		}
+		if !isRedirectCode(i) {
+			return fmt.Errorf("unsupported status code %d, it should be one of 301, 302, 303, 307 or 308", i)
+		}
+		r.Code = i
+
+	case strings.HasPrefix(l, "compress="):
+		l = strings.TrimPrefix(l, "compress=")
+		i, err := strconv.Atoi(l)
+		if err != nil || i < 0 {
+			return fmt.Errorf("could not parse compress threshold: %s", l)
+		}
+		r.Compress = i
+
+	case strings.HasPrefix(l, "corp="):
+		l = strings.TrimPrefix(l, "corp=")
+		if !contains([]string{"same-site", "same-origin", "cross-origin"}, l) {
+			return fmt.Errorf("unsupported corp value: %s", l)
+		}
+		r.CORP = l
+
+	case strings.HasPrefix(l, "documentpolicy="):
+		l = strings.TrimPrefix(l, "documentpolicy=")
+		r.DocumentPolicy = l
+
+	case strings.HasPrefix(l, "family="):
+		l = strings.TrimPrefix(l, "family=")
+		if l != "4" && l != "6" {
+			return fmt.Errorf("unsupported family value: %s", l)
+		}
+		r.Family, _ = strconv.Atoi(l)
+
+	case strings.HasPrefix(l, "flag="):
+		r.Flag = strings.TrimPrefix(l, "flag=")
 
-		case strings.HasPrefix(l, "to="):
-			l = strings.TrimPrefix(l, "to=")
-			l, err := parsePlaceholders(l, req, []string{})
+	case strings.HasPrefix(l, "frameoptions="):
+		l = strings.ToUpper(strings.TrimPrefix(l, "frameoptions="))
+		if _, ok := frameAncestors[l]; !ok {
+			return fmt.Errorf("unsupported frameoptions value: %s", l)
+		}
+		r.FrameOptions = l
+
+	case strings.HasPrefix(l, "from="):
+		l = strings.TrimPrefix(l, "from=")
+		l, err := parsePlaceholders(l, req, []string{})
+		if err != nil {
+			return err
+		}
+		if err := validateFrom(l); err != nil {
+			return err
+		}
+		r.From = l
+
+	case strings.HasPrefix(l, "hours="):
+		hours, err := parseHours(strings.TrimPrefix(l, "hours="))
+		if err != nil {
+			return fmt.Errorf("could not parse hours: %s", err)
+		}
+		r.Hours = hours
+
+	case strings.HasPrefix(l, "lang."):
+		i := strings.Index(l, "=")
+		if i == -1 || i == len("lang.") {
+			return fmt.Errorf("invalid language field %s", l)
+		}
+		to, err := parsePlaceholders(l[i+1:], req, []string{})
+		if err != nil {
+			return err
+		}
+		if to, err = parseURI(to); err != nil {
+			return err
+		}
+		if r.Languages == nil {
+			r.Languages = map[string]string{}
+		}
+		r.Languages[l[len("lang."):i]] = to
+
+	case strings.HasPrefix(l, "max-age="):
+		maxAge, err := strconv.Atoi(strings.TrimPrefix(l, "max-age="))
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("max-age should be a non-negative integer: %s", strings.TrimPrefix(l, "max-age="))
+		}
+		r.MaxAge = &maxAge
+
+	case strings.HasPrefix(l, "nonce="):
+		l, err := strconv.ParseBool(strings.TrimPrefix(l, "nonce="))
+		if err != nil {
+			return fmt.Errorf("could not parse nonce: %s", err)
+		}
+		if l && c.NonceKey == "" {
+			return fmt.Errorf("nonce= field requires a nonce key in the configuration")
+		}
+		r.Nonce = l
+
+	case strings.HasPrefix(l, "permissionspolicy="):
+		l = strings.TrimPrefix(l, "permissionspolicy=")
+		r.PermissionsPolicy = l
+
+	case strings.HasPrefix(l, "preconnect="):
+		l = strings.TrimPrefix(l, "preconnect=")
+		preconnect, err := parseURI(l)
+		if err != nil {
+			return err
+		}
+		r.Preconnect = append(r.Preconnect, preconnect)
+
+	case strings.HasPrefix(l, "prefetch="):
+		l = strings.TrimPrefix(l, "prefetch=")
+		if !strings.HasPrefix(l, "/") {
+			return fmt.Errorf("prefetch= must be a path: %s", l)
+		}
+		r.Prefetch = append(r.Prefetch, l)
+
+	case strings.HasPrefix(l, "fromscheme="):
+		l = strings.TrimPrefix(l, "fromscheme=")
+		r.FromScheme = strings.ToLower(l)
+
+	case strings.HasPrefix(l, "query="):
+		l = strings.TrimPrefix(l, "query=")
+		if l != "preserve" && l != "drop" {
+			return fmt.Errorf("unsupported query value: %s", l)
+		}
+		r.Query = l
+
+	case strings.HasPrefix(l, "re="):
+		l = strings.TrimPrefix(l, "re=")
+		// "record" uses the predefined regexes from the subzones
+		if l != "record" {
+			re, err := regexp.Compile(l)
 			if err != nil {
-				return Record{}, err
+				return fmt.Errorf("could not compile re= regex: %s", err)
 			}
-			l = ParseURI(l, w, req, c)
-			r.To = l
+			r.Regexp = re
+		}
+		r.Re = l
 
-		case strings.HasPrefix(l, "type="):
-			l = strings.TrimPrefix(l, "type=")
-			r.Type = l
+	case strings.HasPrefix(l, "reason="):
+		l = strings.TrimPrefix(l, "reason=")
+		if strings.ContainsAny(l, "\r\n") {
+			return fmt.Errorf("reason phrase can't contain line breaks")
+		}
+		r.Reason = l
 
-		case strings.HasPrefix(l, "use="):
-			l = strings.TrimPrefix(l, "use=")
-			if !strings.HasPrefix(l, "_redirect.") {
-				return Record{}, fmt.Errorf("The given zone address is invalid")
-			}
-			r.Use = append(r.Use, l)
+	case strings.HasPrefix(l, "ref="):
+		l, err := strconv.ParseBool(strings.TrimPrefix(l, "ref="))
+		if err != nil {
+			return fmt.Errorf("could not parse ref: %s", err)
+		}
+		r.Ref = l
 
-		case strings.HasPrefix(l, "v="):
-			l = strings.TrimPrefix(l, "v=")
-			r.Version = l
-			if r.Version != "txtv0" {
-				return Record{}, fmt.Errorf("unhandled version '%s'", r.Version)
-			}
-			log.Print("WARN: txtv0 is not suitable for production")
-
-		case strings.HasPrefix(l, "vcs="):
-			l = strings.TrimPrefix(l, "vcs=")
-			r.Vcs = l
-
-		case strings.HasPrefix(l, "website="):
-			l = strings.TrimPrefix(l, "website=")
-			l = ParseURI(l, w, req, c)
-			r.Website = l
-		case strings.HasPrefix(l, ">"):
-			header := strings.Split(l, "=")
-			h, err := url.PathUnescape(header[1])
+	case strings.HasPrefix(l, "referer="):
+		l = strings.TrimPrefix(l, "referer=")
+		r.Referer = strings.ToLower(l)
+
+	case strings.HasPrefix(l, "refreshheader="):
+		refresh, err := strconv.Atoi(strings.TrimPrefix(l, "refreshheader="))
+		if err != nil || refresh < 0 {
+			return fmt.Errorf("refreshheader should be a non-negative integer: %s", strings.TrimPrefix(l, "refreshheader="))
+		}
+		r.Refresh = &refresh
+
+	case strings.HasPrefix(l, "robots="):
+		l = strings.TrimPrefix(l, "robots=")
+		r.Robots = l
+
+	case strings.HasPrefix(l, "root="):
+		l = strings.TrimPrefix(l, "root=")
+		l, err := parsePlaceholders(l, req, []string{})
+		if err != nil {
+			return err
+		}
+		l, err = parseURI(l)
+		if err != nil {
+			return err
+		}
+		r.Root = l
+
+	case strings.HasPrefix(l, "rootredirect="):
+		l = strings.TrimPrefix(l, "rootredirect=")
+		l, err := parsePlaceholders(l, req, []string{})
+		if err != nil {
+			return err
+		}
+		l, err = parseURI(l)
+		if err != nil {
+			return err
+		}
+		r.RootRedirect = l
+
+	case strings.HasPrefix(l, "scheme="):
+		l = strings.TrimPrefix(l, "scheme=")
+		r.Scheme = strings.ToLower(l)
+
+	case strings.HasPrefix(l, "sunset="):
+		l = strings.TrimPrefix(l, "sunset=")
+		sunset, err := time.Parse(time.RFC3339, l)
+		if err != nil {
+			return fmt.Errorf("could not parse sunset date: %s", err)
+		}
+		r.Sunset = sunset
+
+	case strings.HasPrefix(l, "to="):
+		l = strings.TrimPrefix(l, "to=")
+		targets, err := parseTargets(strings.TrimPrefix(raw, "to="))
+		if err != nil {
+			return err
+		}
+		single := targets == nil
+		if single {
+			targets = []WeightedTarget{{URL: l, Weight: 1}}
+		}
+		for i := range targets {
+			raw := targets[i].URL
+			url, err := parsePlaceholders(raw, req, []string{})
 			if err != nil {
-				return Record{}, err
+				return err
 			}
-			r.Headers[header[0][1:]] = h
-		default:
-			tuple := strings.Split(l, "=")
-			if len(tuple) != 2 {
-				return Record{}, fmt.Errorf("arbitrary data not allowed")
+			if targets[i].URL, err = parseURI(url); err != nil {
+				return err
 			}
-			continue
+			targets[i].Origin = targetOrigin(raw, targets[i].URL)
+		}
+		r.To = targets[0].URL
+		if !single {
+			r.Targets = targets
 		}
-		if len(l) > 255 {
-			return Record{}, fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
+
+	case strings.HasPrefix(l, "type="):
+		l = strings.TrimPrefix(l, "type=")
+		r.Type = l
+
+	case strings.HasPrefix(l, "use="):
+		l = strings.TrimPrefix(l, "use=")
+		if !strings.HasPrefix(l, "_redirect.") {
+			return fmt.Errorf("The given zone address is invalid")
+		}
+		r.Use = append(r.Use, l)
+
+	case strings.HasPrefix(l, "v="):
+		l = strings.TrimPrefix(l, "v=")
+		r.Version = l
+		if r.Version != "txtv0" {
+			return fmt.Errorf("unhandled version '%s'", r.Version)
+		}
+		logger.Print("WARN: txtv0 is not suitable for production")
+
+	case strings.HasPrefix(l, "vcs="):
+		l = strings.TrimPrefix(l, "vcs=")
+		if !contains(vcsTypes, l) {
+			return fmt.Errorf("unsupported vcs %s", l)
+		}
+		r.Vcs = l
+
+	case strings.HasPrefix(l, "website="):
+		website, err := parseURI(strings.TrimPrefix(l, "website="))
+		if err != nil {
+			return err
+		}
+		r.Website = website
+	case strings.HasPrefix(l, ">"):
+		header := splitEscaped(raw, '=')
+		if len(header) < 2 {
+			return fmt.Errorf("header %s doesn't have a value", unescape(header[0][1:]))
 		}
+		h, err := url.PathUnescape(unescape(strings.Join(header[1:], "=")))
+		if err != nil {
+			return err
+		}
+		r.Headers[unescape(header[0][1:])] = h
+	default:
+		// Let the parsers registered by the embedders handle the unknown fields
+		if i := strings.Index(l, "="); i != -1 {
+			if parser, ok := c.RecordParsers[l[:i]]; ok {
+				if err := parser(l[:i], l[i+1:], r); err != nil {
+					return fmt.Errorf("could not parse %s field: %s", l[:i], err)
+				}
+				return nil
+			}
+		}
+
+		tuple := splitEscaped(raw, '=')
+		if len(tuple) != 2 {
+			return fmt.Errorf("arbitrary data not allowed")
+		}
+		return nil
+	}
+	if len(l) > 255 {
+		return fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
 	}
+	return nil
+}
 
-	if r.Type == "dockerv2" && r.To == "" {
-		return Record{}, fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
+// cacheAge returns the max-age of the permanent redirects, which is
+// the record's TTL if it's known or Status301CacheAge otherwise
+func (rec Record) cacheAge() int {
+	if rec.TTL > 0 {
+		return int(rec.TTL)
 	}
+	return Status301CacheAge
+}
 
-	if r.Code == 0 {
-		r.Code = http.StatusFound
+// addCacheControl adds the Cache-Control header for a redirect with the
+// given status code. The record's max-age= field applies to every code,
+// otherwise only the permanent redirects (301 and 308) are cached.
+func (rec Record) addCacheControl(w http.ResponseWriter, code int) {
+	if rec.MaxAge != nil {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", *rec.MaxAge))
+		return
+	}
+	if isPermanent(code) {
+		addPermanentCacheControl(w, rec.cacheAge())
 	}
+}
 
-	// Only apply rules and default to records that doesn't point to a upstream record
-	if len(r.Use) == 0 {
-		if r.Type == "" {
-			r.Type = "host"
+// addRefresh adds a Refresh header pointing to the redirect's target
+// for the clients that don't follow the Location header
+func (rec Record) addRefresh(w http.ResponseWriter, to string) {
+	if rec.Refresh != nil {
+		w.Header().Set("Refresh", fmt.Sprintf("%d; url=%s", *rec.Refresh, to))
+	}
+}
+
+// addPermanentCacheControl sets the Cache-Control header of a
+// permanent redirect to the given max-age
+func addPermanentCacheControl(w http.ResponseWriter, age int) {
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", age))
+}
+
+// isRedirectCode checks if the given status code is allowed in the code= field
+func isRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// isPermanent checks if the given status code is a permanent redirect
+// which browsers are allowed to cache
+func isPermanent(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
+
+// processTarget applies the record's scheme= and query= fields
+// to the given target
+func (rec Record) processTarget(target string, req *http.Request) (string, error) {
+	if rec.Scheme != "" {
+		t, err := setScheme(target, rec.Scheme)
+		if err != nil {
+			return "", fmt.Errorf("could not set the target's scheme: %s", err)
+		}
+		target = t
+	}
+	if rec.Query != "" {
+		t, err := applyQuery(target, rec.Query, req)
+		if err != nil {
+			return "", fmt.Errorf("could not apply the query to the target: %s", err)
 		}
+		target = t
+	}
+	return target, nil
+}
 
-		if r.Type == "host" && r.To == "" {
-			fallback(w, req, "global", http.StatusMovedPermanently, c)
-			return Record{}, nil
+// setScheme replaces the scheme of the given target. Targets without
+// a scheme like "example.com/path" are treated as host and path.
+func setScheme(target, scheme string) (string, error) {
+	if !strings.Contains(target, "://") {
+		target = "//" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	u.Scheme = scheme
+	return u.String(), nil
+}
+
+// applyQuery preserves or drops the request's query on the given target
+// based on the query= field. Preserved parameters don't override the
+// parameters already in the target.
+func applyQuery(target, mode string, r *http.Request) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	if mode == "drop" {
+		u.RawQuery = ""
+		u.ForceQuery = false
+		return u.String(), nil
+	}
+
+	if r.URL == nil || r.URL.RawQuery == "" {
+		return target, nil
+	}
+	query := u.Query()
+	for key, values := range r.URL.Query() {
+		if _, ok := query[key]; !ok {
+			query[key] = values
 		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
 
-		if !contains(c.Enable, r.Type) {
-			return Record{}, fmt.Errorf("%s type is not enabled in configuration", r.Type)
+// fromTemplateRegex matches a from= template made of "/$N" tokens
+var fromTemplateRegex = regexp.MustCompile(`^(/\$\d+)+/?$`)
+
+// validateFrom checks that a from= template like "/$2/$1" can be used
+// to build the zone from the path parts. Values without "$" tokens
+// are left as they are.
+func validateFrom(from string) error {
+	if !strings.Contains(from, "$") {
+		return nil
+	}
+	if !fromTemplateRegex.MatchString(from) {
+		return fmt.Errorf("invalid from= template %s: it should only contain /$N tokens", from)
+	}
+	seen := make(map[int]bool)
+	for _, match := range FromRegex.FindAllStringSubmatch(from, -1) {
+		index, err := strconv.Atoi(match[1])
+		if err != nil || index < 1 {
+			return fmt.Errorf("invalid from= template %s: $%s should be a positive index", from, match[1])
+		}
+		if seen[index] {
+			return fmt.Errorf("invalid from= template %s: $%d is used more than once", from, index)
 		}
+		seen[index] = true
 	}
+	return nil
+}
 
-	return r, nil
+// recordKeys are the fields that make a record without a v= field
+// a txtdirect record
+var recordKeys = []string{"to", "type", "use", "root", "re", "from", "code", "vcs", "website"}
+
+// isRecord checks if the given record fields belong to a txtdirect
+// record. The records with the v= field of another format, like
+// "v=spf1" or "v=DMARC1", aren't and neither are the records without
+// a v= field that don't have any of the recordKeys fields.
+func isRecord(fields []string) bool {
+	for _, field := range fields {
+		if strings.HasPrefix(field, "v=") {
+			return strings.HasPrefix(field, "v=txtv")
+		}
+	}
+	for _, field := range fields {
+		if i := strings.Index(field, "="); i != -1 && contains(recordKeys, field[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// lowerKey lowercases the key of a "key=value" record field and keeps
+// the value as is. Header fields are left untouched since the header
+// names are written exactly as given.
+func lowerKey(field string) string {
+	if strings.HasPrefix(field, ">") {
+		return field
+	}
+	i := strings.Index(field, "=")
+	if i == -1 {
+		return field
+	}
+	return strings.ToLower(field[:i]) + field[i:]
+}
+
+// frameAncestors maps the frameoptions= values to the matching
+// CSP frame-ancestors sources
+var frameAncestors = map[string]string{
+	"DENY":       "'none'",
+	"SAMEORIGIN": "'self'",
+}
+
+// addHeaders adds the response headers defined in the record to the
+// given ResponseWriter
+func (rec Record) addHeaders(w http.ResponseWriter) {
+	for header, val := range rec.Headers {
+		w.Header().Set(header, val)
+	}
+	if rec.Robots != "" {
+		w.Header().Set("X-Robots-Tag", rec.Robots)
+	}
+	if rec.CORP != "" {
+		w.Header().Set("Cross-Origin-Resource-Policy", rec.CORP)
+	}
+	if rec.PermissionsPolicy != "" {
+		w.Header().Set("Permissions-Policy", rec.PermissionsPolicy)
+	}
+	if rec.DocumentPolicy != "" {
+		w.Header().Set("Document-Policy", rec.DocumentPolicy)
+	}
+	// Older browsers only support X-Frame-Options, the newer ones use
+	// the CSP frame-ancestors directive unless the record sets a CSP
+	if rec.FrameOptions != "" {
+		w.Header().Set("X-Frame-Options", rec.FrameOptions)
+		if w.Header().Get("Content-Security-Policy") == "" {
+			w.Header().Set("Content-Security-Policy", "frame-ancestors "+frameAncestors[rec.FrameOptions])
+		}
+	}
+	for _, origin := range rec.Preconnect {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preconnect", origin))
+	}
+	// Clear-Site-Data directives are quoted strings
+	if len(rec.ClearSiteData) != 0 {
+		w.Header().Set("Clear-Site-Data", `"`+strings.Join(rec.ClearSiteData, `", "`)+`"`)
+	}
+	// RFC 8594 uses the HTTP-date format for the Sunset header
+	if !rec.Sunset.IsZero() {
+		w.Header().Set("Sunset", rec.Sunset.UTC().Format(http.TimeFormat))
+	}
 }
 
 // Adds the given record to the request's context with "records" key.
@@ -270,6 +940,12 @@ func (rec *Record) CheckUpstream(w http.ResponseWriter, r *http.Request, c Confi
 			return r, err
 		}
 
+		// Records with use= skip the enabled types check in ParseRecord,
+		// so the final upstream record's type gets validated here
+		if !contains(c.Enable, upstreamRec.Type) {
+			return r, fmt.Errorf("upstream record's %s type is not enabled in configuration", upstreamRec.Type)
+		}
+
 		*rec = upstreamRec
 
 		zoneSplited := strings.Split(zone, ".")
@@ -285,12 +961,27 @@ func (rec *Record) CheckUpstream(w http.ResponseWriter, r *http.Request, c Confi
 
 // ParseURI parses the given URI and triggers fallback if the URI isn't valid
 func ParseURI(uri string, w http.ResponseWriter, r *http.Request, c Config) string {
-	url, err := url.Parse(uri)
+	parsed, err := parseURI(uri)
 	if err != nil {
 		fallback(w, r, "global", http.StatusMovedPermanently, c)
 		return ""
 	}
-	return url.String()
+	return parsed
+}
+
+// parseURI parses the given URI and returns it in its normalized form
+func parseURI(uri string) (string, error) {
+	url, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %s: %s", uri, err)
+	}
+	// url.String re-escapes the fragment and drops an empty one,
+	// so the fragment is passed through exactly as it's written
+	if i := strings.Index(uri, "#"); i != -1 {
+		url.Fragment = ""
+		return url.String() + uri[i:], nil
+	}
+	return url.String(), nil
 }
 
 // getBaseTarget parses the placeholder in the given record's To= field
@@ -327,19 +1018,121 @@ func absoluteZone(zone string) string {
 // query checks the given zone using net.LookupTXT to
 // find TXT records in that zone
 func query(zone string, ctx context.Context, c Config) ([]string, error) {
-	var txts []string
+	res, err := queryTXT(zone, ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return res.Txts, nil
+}
+
+// txtResult is the TXT records of a zone along with their TTL
+// in seconds. The TTL is zero when it isn't known.
+type txtResult struct {
+	Txts []string
+	TTL  uint32
+}
+
+// queryTXT works like query but also returns the records' TTL
+func queryTXT(zone string, ctx context.Context, c Config) (txtResult, error) {
+	defer trackTiming(ctx, "dns", time.Now())
+
+	if c.CacheEnable {
+		if res, ok := cache.get(absoluteZone(zone)); ok {
+			return res, nil
+		}
+	}
+
+	if c.MaxConcurrentQueries > 0 {
+		release, err := acquireQuerySlot(ctx, c.MaxConcurrentQueries)
+		if err != nil {
+			return txtResult{}, fmt.Errorf("could not get TXT record: %s", err)
+		}
+		defer release()
+	}
+
+	var res txtResult
 	var err error
-	if c.Resolver != "" {
-		net := customResolver(c)
-		txts, err = net.LookupTXT(ctx, absoluteZone(zone))
+	if c.ResolverRace && len(c.Resolvers) != 0 {
+		res, err = raceLookup(absoluteZone(zone), ctx, c)
 	} else {
-		txts, err = net.LookupTXT(absoluteZone(zone))
+		res, err = lookupWithRetries(absoluteZone(zone), ctx, c)
+	}
+
+	// Only fall back to the secondary resolver if the zone doesn't exist on
+	// the primary one, other errors like timeouts are returned as is
+	if err != nil && c.SecondaryResolver != "" && isNotFound(err) {
+		logger.Printf("[txtdirect]: %s doesn't exist on the primary resolver, querying %s", zone, c.SecondaryResolver)
+		secondary := c
+		secondary.Resolver = c.SecondaryResolver
+		res, err = lookupTXT(absoluteZone(zone), ctx, secondary)
+	}
+
+	// The record API is used when the zone couldn't be resolved over DNS
+	if err != nil && c.RecordAPI != "" {
+		logger.Printf("[txtdirect]: Couldn't resolve %s over DNS, querying the record API: %s", zone, err)
+		res, err = apiLookupTXT(absoluteZone(zone), ctx, c)
+	}
+
+	// Serve the last known record if the zone couldn't be resolved at all.
+	// The zones that don't exist anymore aren't served from the cache.
+	if err != nil && c.CacheEnable && c.StaleOnError && !isNotFound(err) {
+		if stale, ok := cache.getStale(absoluteZone(zone)); ok {
+			logger.Printf("[txtdirect]: Couldn't resolve %s, serving the expired cached record: %s", zone, err)
+			return stale, nil
+		}
 	}
 	if err != nil {
-		return nil, fmt.Errorf("could not get TXT record: %s", err)
+		return txtResult{}, fmt.Errorf("could not get TXT record: %w", err)
+	}
+	if c.MaxTXTAnswers > 0 && len(res.Txts) > c.MaxTXTAnswers {
+		return txtResult{}, fmt.Errorf("zone returned %d TXT records, the maximum is %d", len(res.Txts), c.MaxTXTAnswers)
+	}
+	if res.Txts[0] == "" {
+		return txtResult{}, fmt.Errorf("TXT record doesn't exist or is empty")
+	}
+	if c.CacheEnable && res.TTL > 0 {
+		cache.set(absoluteZone(zone), res, c.CacheMaxEntries)
+	}
+	return res, nil
+}
+
+// lookupTXT looks up the TXT records of the given zone using the
+// resolver from the config or the system's resolver. The returned
+// TTL is zero when the lookup method doesn't expose it.
+func lookupTXT(zone string, ctx context.Context, c Config) (txtResult, error) {
+	if isMDNSZone(zone, c) {
+		txts, err := queryMDNS(zone, ctx)
+		return txtResult{Txts: txts}, err
 	}
-	if txts[0] == "" {
-		return nil, fmt.Errorf("TXT record doesn't exist or is empty")
+
+	switch c.ResolverProtocol {
+	case "", "udp", "tcp", "dot":
+	case "doh":
+		return dohLookupTXT(zone, ctx, c)
+	default:
+		return txtResult{}, fmt.Errorf("unsupported resolver protocol %s", c.ResolverProtocol)
+	}
+
+	if useDNSClient(c) {
+		return exchangeTXT(zone, ctx, c)
 	}
-	return txts, nil
+
+	// net.Resolver doesn't expose the TTLs, so these
+	// answers can't be cached
+	var txts []string
+	var err error
+	if c.Resolver != "" {
+		net := customResolver(c)
+		txts, err = net.LookupTXT(ctx, zone)
+	} else {
+		txts, err = net.LookupTXT(zone)
+	}
+	return txtResult{Txts: txts}, err
+}
+
+// isNotFound checks if the given lookup error means
+// the zone doesn't exist
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
 }
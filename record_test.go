@@ -17,8 +17,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestParseRecord(t *testing.T) {
@@ -26,7 +29,6 @@ func TestParseRecord(t *testing.T) {
 		txtRecord string
 		expected  Record
 		err       error
-		status    int
 	}{
 		{
 			txtRecord: "v=txtv0;to=https://example.com/;code=302",
@@ -58,6 +60,15 @@ func TestParseRecord(t *testing.T) {
 			},
 			err: nil,
 		},
+		{
+			txtRecord: "to=https://example.com/;code=302",
+			expected: Record{
+				To:   "https://example.com/",
+				Code: 302,
+				Type: "host",
+			},
+			err: nil,
+		},
 		{
 			txtRecord: "v=txtv0;to=https://example.com/;code=302;vcs=hg;type=gometa",
 			expected: Record{
@@ -116,45 +127,279 @@ func TestParseRecord(t *testing.T) {
 			err: nil,
 		},
 		{
-			txtRecord: "v=txtv0;to={?url}",
+			txtRecord: "v=txtv0;to=https://example.com/;type=gometa;compress=1024",
+			expected: Record{
+				Version:  "txtv0",
+				To:       "https://example.com/",
+				Code:     302,
+				Type:     "gometa",
+				Compress: 1024,
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;type=gometa;compress=big",
+			expected:  Record{},
+			err:       fmt.Errorf("could not parse compress threshold"),
+		},
+		{
+			txtRecord: `v=txtv0;to=https://example.com/;altsvc=h3=":443"%3B%20ma=2592000`,
 			expected: Record{
 				Version: "txtv0",
-				To:      "https://example.com/testing",
+				To:      "https://example.com/",
 				Code:    302,
 				Type:    "host",
+				AltSvc:  `h3=":443"; ma=2592000`,
 			},
 			err: nil,
 		},
 		{
-			txtRecord: "v=txtv0;to={?url};from={method}",
+			txtRecord: "v=txtv0;to=https://example.com/;referer=Example.com",
 			expected: Record{
 				Version: "txtv0",
-				To:      "https://example.com/testing",
+				To:      "https://example.com/",
 				Code:    302,
 				Type:    "host",
-				From:    "GET",
+				Referer: "example.com",
 			},
 			err: nil,
 		},
 		{
-			txtRecord: "v=txtv0;ref=true;code=302",
+			txtRecord: "v=txtv0;to=https://example.com/;robots=noindex,nofollow",
 			expected: Record{
 				Version: "txtv0",
+				To:      "https://example.com/",
+				Code:    302,
 				Type:    "host",
+				Robots:  "noindex,nofollow",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "V=txtv0;TO=https://example.com/Path;Code=301;Type=gometa;VCS=git",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/Path",
+				Code:    301,
+				Type:    "gometa",
+				Vcs:     "git",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;rootredirect=https://home.example.com",
+			expected: Record{
+				Version:      "txtv0",
+				To:           "https://example.com/",
+				Code:         302,
+				Type:         "host",
+				RootRedirect: "https://home.example.com",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;rootredirect=http://home.example.com/?a=1;query=preserve;scheme=https",
+			expected: Record{
+				Version:      "txtv0",
+				To:           "https://example.com/?url=https%3A%2F%2Fexample.com%2Ftesting",
+				Code:         302,
+				Type:         "host",
+				RootRedirect: "https://home.example.com/?a=1&url=https%3A%2F%2Fexample.com%2Ftesting",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;sunset=2025-12-31",
+			err:       fmt.Errorf("could not parse sunset date"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;hours=09:00-17:00/Mars/Olympus",
+			err:       fmt.Errorf("could not parse hours"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;hours=09:00-17:00",
+			err:       fmt.Errorf("hours= requires an afterhours.to= target"),
+		},
+		{
+			txtRecord: "v=txtv0;scheme=https;to=http://example.com/path?q=1",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/path?q=1",
 				Code:    302,
-				Ref:     true,
+				Type:    "host",
 			},
-			status: 404,
+			err: nil,
 		},
 		{
-			txtRecord: "v=txtv0;ref=false;code=302",
+			txtRecord: "v=txtv0;to=example.com/path;scheme=https",
 			expected: Record{
 				Version: "txtv0",
+				To:      "https://example.com/path",
+				Code:    302,
 				Type:    "host",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;scheme=ftp",
+			expected: Record{
+				Version: "txtv0",
+				To:      "ftp://example.com/",
 				Code:    302,
-				Ref:     false,
+				Type:    "host",
 			},
-			status: 404,
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/?a=1;query=preserve",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/?a=1&url=https%3A%2F%2Fexample.com%2Ftesting",
+				Code:    302,
+				Type:    "host",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;query=drop;to=https://example.com/?a=1",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/",
+				Code:    302,
+				Type:    "host",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;query=keep",
+			err:       fmt.Errorf("unsupported query value"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;corp=everyone",
+			err:       fmt.Errorf("unsupported corp value"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;clearsitedata=cookies,everything",
+			err:       fmt.Errorf("unsupported clearsitedata value"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;family=5",
+			err:       fmt.Errorf("unsupported family value"),
+		},
+		{
+			txtRecord: "v=txtv0;type=path;re=/(\\w+",
+			err:       fmt.Errorf("could not compile re= regex"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://x.example/?a=1\\;b=2;code=302",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://x.example/?a=1;b=2",
+				Code:    302,
+				Type:    "host",
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://x.example/;>X-Token=a\\=b\\;c;>X-Query=a=1",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://x.example/",
+				Code:    302,
+				Type:    "host",
+				Headers: map[string]string{
+					"X-Token": "a=b;c",
+					"X-Query": "a=1",
+				},
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://x.example/;>X-Token",
+			err:       fmt.Errorf("header X-Token doesn't have a value"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;ref=maybe",
+			err:       fmt.Errorf("could not parse ref"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;website=http://[::1",
+			err:       fmt.Errorf("invalid URI http://[::1"),
+		},
+		{
+			txtRecord: "v=txtv0;type=path;from=/$a/$1",
+			err:       fmt.Errorf("invalid from= template /$a/$1"),
+		},
+		{
+			txtRecord: "v=txtv0;type=path;from=/$1/$1",
+			err:       fmt.Errorf("invalid from= template /$1/$1"),
+		},
+		{
+			txtRecord: "v=txtv0;type=path;from=/$0",
+			err:       fmt.Errorf("invalid from= template /$0"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;type=gometa;vcs=cvs",
+			err:       fmt.Errorf("unsupported vcs cvs"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;frameoptions=allow-from",
+			err:       fmt.Errorf("unsupported frameoptions value"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;code=200",
+			err:       fmt.Errorf("unsupported status code 200"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;max-age=-1",
+			err:       fmt.Errorf("max-age should be a non-negative integer"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;max-age=week",
+			err:       fmt.Errorf("max-age should be a non-negative integer"),
+		},
+		{
+			txtRecord: "v=txtv0;to=https://example.com/;refreshheader=soon",
+			err:       fmt.Errorf("refreshheader should be a non-negative integer"),
+		},
+		{
+			txtRecord: "v=spf1 include:_spf.example.com ~all",
+			err:       fmt.Errorf("not a txtdirect record"),
+		},
+		{
+			txtRecord: "v=DMARC1; p=none",
+			err:       fmt.Errorf("not a txtdirect record"),
+		},
+		{
+			txtRecord: "google-site-verification=abc123",
+			err:       fmt.Errorf("not a txtdirect record"),
+		},
+		{
+			txtRecord: "v=txtv0;to={?url}",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/testing",
+				Code:    302,
+				Type:    "host",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;to={?url};from={method}",
+			expected: Record{
+				Version: "txtv0",
+				To:      "https://example.com/testing",
+				Code:    302,
+				Type:    "host",
+				From:    "GET",
+			},
+			err: nil,
+		},
+		{
+			txtRecord: "v=txtv0;ref=true;code=302",
+			err:       ErrMissingTarget,
+		},
+		{
+			txtRecord: "v=txtv0;ref=false;code=302",
+			err:       ErrMissingTarget,
 		},
 		{
 			txtRecord: "v=txtv0;type=path;code=302;>Header-1=HeaderValue",
@@ -344,6 +589,11 @@ func TestParseRecord(t *testing.T) {
 		w := httptest.NewRecorder()
 		r, err := ParseRecord(test.txtRecord, w, req, c)
 
+		// The fallbacks are triggered by the callers, not while parsing
+		if w.Code != http.StatusOK || len(w.Header()) != 0 || w.Body.Len() != 0 {
+			t.Errorf("Test %d: Expected the response to be untouched, got status %d and headers %v", i, w.Code, w.Header())
+		}
+
 		if err != nil {
 			if test.err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
 				t.Errorf("Test %d: Unexpected error: %s", i, err)
@@ -351,13 +601,6 @@ func TestParseRecord(t *testing.T) {
 			continue
 		}
 
-		if test.status != 0 {
-			if w.Result().StatusCode != test.status {
-				t.Errorf("Test %d: Expected status code %d, got %d", i, test.status, w.Result().StatusCode)
-			}
-			continue
-		}
-
 		if err == nil && test.err != nil {
 			t.Errorf("Test %d: Expected error, got nil", i)
 			continue
@@ -378,6 +621,21 @@ func TestParseRecord(t *testing.T) {
 		if got, want := r.Vcs, test.expected.Vcs; got != want {
 			t.Errorf("Test %d: Expected Vcs to be '%s', got '%s'", i, want, got)
 		}
+		if got, want := r.Compress, test.expected.Compress; got != want {
+			t.Errorf("Test %d: Expected Compress to be '%d', got '%d'", i, want, got)
+		}
+		if got, want := r.Referer, test.expected.Referer; got != want {
+			t.Errorf("Test %d: Expected Referer to be '%s', got '%s'", i, want, got)
+		}
+		if got, want := r.RootRedirect, test.expected.RootRedirect; got != want {
+			t.Errorf("Test %d: Expected RootRedirect to be '%s', got '%s'", i, want, got)
+		}
+		if got, want := r.Robots, test.expected.Robots; got != want {
+			t.Errorf("Test %d: Expected Robots to be '%s', got '%s'", i, want, got)
+		}
+		if got, want := r.AltSvc, test.expected.AltSvc; got != want {
+			t.Errorf("Test %d: Expected AltSvc to be '%s', got '%s'", i, want, got)
+		}
 
 		if len(r.Headers) != len(test.expected.Headers) {
 			t.Errorf("Test %d: Expected %d headers, got '%d'", i, len(r.Headers), len(test.expected.Headers))
@@ -398,3 +656,258 @@ func TestParseRecord(t *testing.T) {
 		}
 	}
 }
+
+func TestGetRecordHeaders(t *testing.T) {
+	tests := []struct {
+		host    string
+		headers map[string]string
+	}{
+		{
+			host: "headers.host.example.com",
+			headers: map[string]string{
+				"X-Robots-Tag":                 "noindex,nofollow",
+				"Permissions-Policy":           "geolocation=(), camera=()",
+				"Document-Policy":              "force-load-at-top, oversized-images=2.0",
+				"Sunset":                       "Wed, 31 Dec 2025 00:00:00 GMT",
+				"Cross-Origin-Resource-Policy": "same-origin",
+				"Clear-Site-Data":              `"cookies", "storage"`,
+			},
+		},
+		{
+			host: "host.host.example.com",
+			headers: map[string]string{
+				"TestHeader":                   "TestValue",
+				"X-Robots-Tag":                 "",
+				"Permissions-Policy":           "",
+				"Document-Policy":              "",
+				"Sunset":                       "",
+				"Cross-Origin-Resource-Policy": "",
+				"Clear-Site-Data":              "",
+			},
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host, nil)
+		w := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+		}
+		if _, err := GetRecord(test.host, c, w, req); err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		for header, value := range test.headers {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("Test %d: Expected %s header to be '%s', got '%s'", i, header, value, got)
+			}
+		}
+	}
+}
+
+func TestCheckUpstreamDisabledType(t *testing.T) {
+	tests := []struct {
+		enable []string
+		err    bool
+	}{
+		{
+			enable: []string{"host"},
+			err:    true,
+		},
+		{
+			enable: []string{"host", "gometa"},
+			err:    false,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://disabled.host.example.com", nil)
+		w := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   test.enable,
+		}
+		rec, err := GetRecord(req.Host, c, w, req)
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+
+		_, err = rec.CheckUpstream(w, req, c)
+		if test.err && err == nil {
+			t.Errorf("Test %d: Expected an error for the upstream's %s type", i, rec.Type)
+		}
+		if !test.err && err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+		}
+	}
+}
+
+func TestGetRecordPreconnect(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://preconnect.host.example.com", nil)
+	w := httptest.NewRecorder()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+	}
+	if _, err := GetRecord(req.Host, c, w, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []string{
+		"<https://cdn.example.com>; rel=preconnect",
+		"<https://fonts.example.com>; rel=preconnect",
+	}
+	links := w.Header()["Link"]
+	if len(links) != len(expected) {
+		t.Fatalf("Expected %d Link headers, got %v", len(expected), links)
+	}
+	for i, link := range links {
+		if link != expected[i] {
+			t.Errorf("Expected Link header to be '%s', got '%s'", expected[i], link)
+		}
+	}
+}
+
+func TestParseRecordCustomParser(t *testing.T) {
+	c := Config{
+		Enable: []string{"host"},
+		RecordParsers: map[string]func(key, value string, r *Record) error{
+			"team": func(key, value string, r *Record) error {
+				if value == "" {
+					return fmt.Errorf("empty %s", key)
+				}
+				r.Headers["X-Team"] = value
+				return nil
+			},
+		},
+	}
+	req := httptest.NewRequest("GET", "https://example.com", nil)
+	w := httptest.NewRecorder()
+
+	r, err := ParseRecord("v=txtv0;to=https://example.com/;team=platform=core", w, req, c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r.Headers["X-Team"] != "platform=core" {
+		t.Errorf("Expected the custom parser to set X-Team to 'platform=core', got '%s'", r.Headers["X-Team"])
+	}
+
+	if _, err := ParseRecord("v=txtv0;to=https://example.com/;team=", w, req, c); err == nil {
+		t.Errorf("Expected the custom parser's error to be returned")
+	}
+}
+
+func TestParseURIFragment(t *testing.T) {
+	tests := []string{
+		"https://example.com/page#section",
+		"https://example.com/page#a%2Fb",
+		"https://example.com/app?q=1#!/route?x=1",
+		"https://example.com/page#",
+		"https://example.com/page",
+	}
+	for i, uri := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		w := httptest.NewRecorder()
+		rec, err := ParseRecord("v=txtv0;to="+uri, w, req, Config{Enable: []string{"host"}})
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != uri {
+			t.Errorf("Test %d: Expected to= to be %s, got %s", i, uri, rec.To)
+		}
+
+		NewHost(w, req, rec, Config{}).Redirect()
+		if location := w.Header().Get("Location"); location != uri {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, uri, location)
+		}
+	}
+}
+
+func TestGetRecordShuffleAnswers(t *testing.T) {
+	targets := []string{"https://a.example.com", "https://b.example.com"}
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := txtReply(r, "v=spf1 -all")
+		for _, target := range targets {
+			m.Answer = append(m.Answer, txtReply(r, "v=txtv0;to="+target).Answer...)
+		}
+		w.WriteMsg(m)
+	})
+	c := Config{
+		Resolver: addr,
+		Enable:   []string{"host"},
+	}
+
+	req := httptest.NewRequest("GET", "https://shuffle.example.com/", nil)
+	if _, err := GetRecord("_redirect.shuffle.example.com", c, httptest.NewRecorder(), req); err == nil {
+		t.Errorf("Expected an error for multiple records without ShuffleAnswers")
+	}
+
+	c.ShuffleAnswers = true
+	const iterations = 200
+	counts := map[string]int{}
+	for i := 0; i < iterations; i++ {
+		req := httptest.NewRequest("GET", "https://shuffle.example.com/", nil)
+		rec, err := GetRecord("_redirect.shuffle.example.com", c, httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		counts[rec.To]++
+	}
+	for _, target := range targets {
+		if counts[target] < iterations/4 {
+			t.Errorf("Expected %s to be picked about half of the time, got %d of %d", target, counts[target], iterations)
+		}
+	}
+	if len(counts) != len(targets) {
+		t.Errorf("Expected only the txtdirect records to be picked, got %v", counts)
+	}
+}
+
+func TestGetRecordWildcardPolicy(t *testing.T) {
+	addr := startDNSServer(t, "udp", txtHandler(map[string]string{
+		"_redirect.a.apex.example.com.":     "v=txtv0;to=https://apex.test",
+		"_redirect._.apex.example.com.":     "v=txtv0;to=https://apex-wildcard.test",
+		"_redirect._.a.both.example.com.":   "v=txtv0;to=https://subzone.test",
+		"_redirect._.both.example.com.":     "v=txtv0;to=https://wildcard.test",
+		"_redirect._.wildcard.example.com.": "v=txtv0;to=https://wildcard-only.test",
+	}))
+
+	tests := []struct {
+		host   string
+		policy string
+		to     string
+		err    bool
+	}{
+		{host: "a.apex.example.com", policy: "", to: "https://apex.test"},
+		{host: "a.apex.example.com", policy: "apex-first", to: "https://apex.test"},
+		{host: "a.both.example.com", policy: "", to: "https://subzone.test"},
+		{host: "a.both.example.com", policy: "specific-first", to: "https://subzone.test"},
+		{host: "a.both.example.com", policy: "apex-first", to: "https://wildcard.test"},
+		{host: "a.wildcard.example.com", policy: "specific-first", to: "https://wildcard-only.test"},
+		{host: "a.wildcard.example.com", policy: "apex-first", to: "https://wildcard-only.test"},
+		{host: "a.missing.example.com", policy: "", err: true},
+		{host: "a.apex.example.com", policy: "random", err: true},
+	}
+	for i, test := range tests {
+		c := Config{
+			Resolver:       addr,
+			Enable:         []string{"host"},
+			WildcardPolicy: test.policy,
+		}
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		rec, err := GetRecord(test.host, c, httptest.NewRecorder(), req)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %+v", i, rec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.to {
+			t.Errorf("Test %d: Expected the record of %s, got %s", i, test.to, rec.To)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// recordAPIClient is the HTTP client used for the record API requests
+var recordAPIClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// recordAPIResponse is the JSON body returned by the record API
+// e.g. {"txt": ["v=txtv0;to=https://example.com"], "ttl": 300}
+type recordAPIResponse struct {
+	Txt []string `json:"txt"`
+	TTL uint32   `json:"ttl"`
+}
+
+// apiLookupTXT fetches the records of the given zone from the record API
+// with a "GET <RecordAPI>/records?host=<host>" request. A 404 response
+// is treated the same way as a zone that doesn't exist.
+func apiLookupTXT(zone string, ctx context.Context, c Config) (txtResult, error) {
+	host := strings.TrimSuffix(strings.TrimPrefix(zone, basezone+"."), ".")
+
+	endpoint := strings.TrimSuffix(c.RecordAPI, "/") + "/records?host=" + url.QueryEscape(host)
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return txtResult{}, fmt.Errorf("invalid record API endpoint %s: %s", c.RecordAPI, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := recordAPIClient.Do(req)
+	if err != nil {
+		return txtResult{}, fmt.Errorf("record API lookup %s: %s", host, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return txtResult{}, &net.DNSError{Err: "no such host", Name: zone, Server: c.RecordAPI, IsNotFound: true}
+	}
+	if res.StatusCode != http.StatusOK {
+		return txtResult{}, fmt.Errorf("record API lookup %s: unexpected status %s", host, res.Status)
+	}
+
+	var body recordAPIResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return txtResult{}, fmt.Errorf("record API lookup %s: invalid response: %s", host, err)
+	}
+	if len(body.Txt) == 0 {
+		return txtResult{}, fmt.Errorf("record API lookup %s: no records found", host)
+	}
+	return txtResult{Txts: body.Txt, TTL: body.TTL}, nil
+}
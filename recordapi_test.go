@@ -0,0 +1,77 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_queryRecordAPI(t *testing.T) {
+	cache.reset()
+	t.Cleanup(cache.reset)
+
+	var mu sync.Mutex
+	requests := map[string]int{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.URL.Query().Get("host")
+		mu.Lock()
+		requests[host]++
+		mu.Unlock()
+
+		if r.URL.Path != "/records" || host != "dynamic.example.org" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"txt": ["v=txtv0;to=https://dynamic.test"], "ttl": 300}`)
+	}))
+	defer api.Close()
+
+	c := Config{
+		Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+		RecordAPI:    api.URL,
+		CacheEnable:  true,
+		QueryRetries: -1,
+	}
+	for i := 0; i < 2; i++ {
+		txts, err := query("dynamic.example.org", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if txts[0] != "v=txtv0;to=https://dynamic.test" {
+			t.Errorf("Unexpected TXT record: %s", txts[0])
+		}
+	}
+	if n := requests["dynamic.example.org"]; n != 1 {
+		t.Errorf("Expected the API response to be cached, got %d requests", n)
+	}
+
+	// Records that exist on DNS don't reach the API
+	if _, err := query("about.host.host.example.com", context.Background(), c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n := requests["about.host.host.example.com"]; n != 0 {
+		t.Errorf("Expected the DNS records to be used, got %d API requests", n)
+	}
+
+	if _, err := query("missing.example.org", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for a host that the API doesn't know")
+	}
+}
@@ -0,0 +1,523 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// ednsUDPSize is the default advertised EDNS0 UDP buffer size for
+	// queries sent through the miekg/dns client
+	ednsUDPSize = 1232
+
+	// mdnsTimeout is the maximum time to wait for an mDNS responder
+	mdnsTimeout = 2 * time.Second
+
+	// defaultQueryRetries and defaultQueryRetryBackoff are used
+	// when QueryRetries and QueryRetryBackoff aren't set
+	defaultQueryRetries      = 2
+	defaultQueryRetryBackoff = 100 * time.Millisecond
+
+	// querySlotTimeout is the maximum time a query waits for a free slot
+	// when the number of concurrent queries is limited
+	querySlotTimeout = 500 * time.Millisecond
+
+	// maxAliasDepth is the maximum number of aliases followed for a zone
+	maxAliasDepth = 8
+)
+
+// mdnsAddr is the multicast address and port used for mDNS queries
+var mdnsAddr = "224.0.0.251:5353"
+
+// cookieJar keeps the DNS Cookies (RFC 7873) used for each resolver
+type cookieJar struct {
+	sync.Mutex
+	client map[string]string
+	server map[string]string
+}
+
+var cookies = cookieJar{
+	client: map[string]string{},
+	server: map[string]string{},
+}
+
+// querySlots limits the number of concurrent queries across all requests
+var querySlots struct {
+	sync.Mutex
+	slots chan struct{}
+}
+
+// acquireQuerySlot waits for a free query slot and returns a function
+// that releases it. It returns an error if no slot gets free in time.
+func acquireQuerySlot(ctx context.Context, max int) (func(), error) {
+	querySlots.Lock()
+	if cap(querySlots.slots) != max {
+		querySlots.slots = make(chan struct{}, max)
+	}
+	slots := querySlots.slots
+	querySlots.Unlock()
+
+	timer := time.NewTimer(querySlotTimeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("too many concurrent queries, the maximum is %d", max)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolvConf is the resolver configuration used by the miekg/dns
+// client when there isn't a custom resolver
+var resolvConf = "/etc/resolv.conf"
+
+// lookupWithRetries calls lookupTXT and retries the transient failures
+// with an exponential backoff until the retries or the context's
+// deadline run out
+func lookupWithRetries(zone string, ctx context.Context, c Config) (txtResult, error) {
+	retries := c.QueryRetries
+	if retries == 0 {
+		retries = defaultQueryRetries
+	}
+	backoff := c.QueryRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultQueryRetryBackoff
+	}
+
+	attempts := 1
+	res, err := lookupTXT(zone, ctx, c)
+	for ; err != nil && isTransient(err) && attempts <= retries; attempts++ {
+		if d, ok := ctx.Deadline(); ok && time.Until(d) < backoff {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return txtResult{}, fmt.Errorf("%s (after %d attempts)", err, attempts)
+		}
+		backoff *= 2
+		res, err = lookupTXT(zone, ctx, c)
+	}
+
+	// Keep the not found errors as is for the secondary resolver
+	if err != nil && attempts > 1 && !isNotFound(err) {
+		return txtResult{}, fmt.Errorf("%s (after %d attempts)", err, attempts)
+	}
+	return res, err
+}
+
+// raceLookup queries Resolver and all of the Resolvers at the same time
+// and returns the first successful answer. The other queries get
+// cancelled once there's an answer.
+func raceLookup(zone string, ctx context.Context, c Config) (txtResult, error) {
+	resolvers := append([]string{c.Resolver}, c.Resolvers...)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type answer struct {
+		res txtResult
+		err error
+	}
+	answers := make(chan answer, len(resolvers))
+	for _, resolver := range resolvers {
+		rc := c
+		rc.Resolver = resolver
+		go func() {
+			res, err := lookupWithRetries(zone, ctx, rc)
+			answers <- answer{res, err}
+		}()
+	}
+
+	var err error
+	for range resolvers {
+		a := <-answers
+		if a.err == nil {
+			return a.res, nil
+		}
+		// Keep the not found errors for the secondary resolver
+		if err == nil || isNotFound(a.err) {
+			err = a.err
+		}
+	}
+	return txtResult{}, err
+}
+
+// isTransient checks if the given lookup error is likely to be
+// temporary, like a timeout or a resolver failure
+func isTransient(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return !dnsErr.IsNotFound && (dnsErr.IsTimeout || dnsErr.IsTemporary || dnsErr.Err == "server misbehaving")
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	// The miekg/dns errors are wrapped into strings
+	msg := err.Error()
+	return strings.Contains(msg, "i/o timeout") || strings.Contains(msg, "server misbehaving") ||
+		strings.HasSuffix(msg, dns.RcodeToString[dns.RcodeServerFailure])
+}
+
+// useDNSClient checks if the given config enables the miekg/dns client
+// or needs features that are only available through it instead of
+// net.Resolver
+func useDNSClient(c Config) bool {
+	if c.DNSClient || c.CacheEnable || c.DNSTCPOnly || c.ResolverProtocol == "dot" {
+		return true
+	}
+	return c.Resolver != "" && (c.DNSCookies || c.DNSClass != "" || c.UDPBufferSize != 0 || c.RetryOnEmpty || c.Use0x20 || c.FollowAliases)
+}
+
+// resolverProtocol returns the protocol used to query the resolver,
+// which is "tcp" instead of "udp" if DNSTCPOnly is set
+func resolverProtocol(c Config) string {
+	if c.DNSTCPOnly && (c.ResolverProtocol == "" || c.ResolverProtocol == "udp") {
+		return "tcp"
+	}
+	return c.ResolverProtocol
+}
+
+// clientResolver returns the address of the resolver used by the
+// miekg/dns client. It's the custom resolver if there's one,
+// otherwise the first nameserver from the system's configuration.
+func clientResolver(c Config) (string, error) {
+	if c.Resolver != "" {
+		if c.ResolverProtocol == "dot" {
+			return resolverAddr(c.Resolver, "853"), nil
+		}
+		return resolverAddr(c.Resolver, "53"), nil
+	}
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("could not read the system's resolver: %s", err)
+	}
+	if len(conf.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers found in %s", resolvConf)
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// exchangeTXT sends a TXT query for the given zone to the configured
+// resolver using the miekg/dns client
+func exchangeTXT(zone string, ctx context.Context, c Config) (txtResult, error) {
+	resolver, err := clientResolver(c)
+	if err != nil {
+		return txtResult{}, err
+	}
+
+	resp, err := exchange(zone, dns.TypeTXT, ctx, c, resolver)
+	if err != nil {
+		return txtResult{}, err
+	}
+
+	// Retry once with the fresh server cookie if the resolver rejected ours
+	if c.DNSCookies && resp.Rcode == dns.RcodeBadCookie {
+		if resp, err = exchange(zone, dns.TypeTXT, ctx, c, resolver); err != nil {
+			return txtResult{}, err
+		}
+	}
+
+	res, err := txtAnswers(zone, resolver, resp)
+
+	// Some anycast resolvers occasionally answer with an empty set
+	// that succeeds on the next try
+	if err == nil && len(res.Txts) == 0 && c.RetryOnEmpty {
+		if resp, err = exchange(zone, dns.TypeTXT, ctx, c, resolver); err != nil {
+			return txtResult{}, err
+		}
+		res, err = txtAnswers(zone, resolver, resp)
+	}
+	if err != nil {
+		return txtResult{}, err
+	}
+
+	// Resolvers that don't flatten the ALIAS/ANAME or CNAME of a zone
+	// only return the alias, so its target is queried instead
+	for depth := 0; len(res.Txts) == 0 && c.FollowAliases; depth++ {
+		target := aliasTarget(zone, resp)
+		if target == "" {
+			break
+		}
+		if depth == maxAliasDepth {
+			return txtResult{}, fmt.Errorf("lookup %s on %s: too many aliases", zone, resolver)
+		}
+		zone = target
+		if resp, err = exchange(zone, dns.TypeTXT, ctx, c, resolver); err != nil {
+			return txtResult{}, err
+		}
+		if res, err = txtAnswers(zone, resolver, resp); err != nil {
+			return txtResult{}, err
+		}
+	}
+
+	if len(res.Txts) == 0 {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: no TXT records found", zone, resolver)
+	}
+	return res, nil
+}
+
+// aliasTarget follows the CNAME chain of the given zone in the answer
+// section and returns its last target, or "" if the zone has no alias
+func aliasTarget(zone string, resp *dns.Msg) string {
+	target := ""
+	name := dns.Fqdn(zone)
+	for i := 0; i <= len(resp.Answer); i++ {
+		found := false
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target, name, found = cname.Target, cname.Target, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+	return target
+}
+
+// txtAnswers returns the TXT records from the given response and their
+// lowest TTL or an error if the response's rcode isn't successful
+func txtAnswers(zone, resolver string, resp *dns.Msg) (txtResult, error) {
+	if resp.Rcode == dns.RcodeNameError {
+		return txtResult{}, &net.DNSError{Err: "no such host", Name: zone, Server: resolver, IsNotFound: true}
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return txtResult{}, fmt.Errorf("lookup %s on %s: %s", zone, resolver, dns.RcodeToString[resp.Rcode])
+	}
+
+	var res txtResult
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			res.Txts = append(res.Txts, strings.Join(txt.Txt, ""))
+			if len(res.Txts) == 1 || txt.Hdr.Ttl < res.TTL {
+				res.TTL = txt.Hdr.Ttl
+			}
+		}
+	}
+	return res, nil
+}
+
+// exchange sends a single query to the given resolver and retries
+// over TCP if the UDP response was truncated
+func exchange(zone string, qtype uint16, ctx context.Context, c Config, resolver string) (*dns.Msg, error) {
+	m, err := newQuery(zone, qtype, c)
+	if err != nil {
+		return nil, err
+	}
+	if c.Use0x20 {
+		if m.Question[0].Name, err = randomCase(zone); err != nil {
+			return nil, err
+		}
+	}
+	if c.DNSCookies {
+		cookies.add(m, resolver)
+	}
+
+	var resp *dns.Msg
+	switch resolverProtocol(c) {
+	case "dot":
+		resp, err = dotExchange(m, ctx, c, resolver)
+	case "tcp":
+		client := dns.Client{Net: "tcp"}
+		resp, _, err = client.ExchangeContext(ctx, m, resolver)
+	default:
+		client := dns.Client{}
+		resp, _, err = client.ExchangeContext(ctx, m, resolver)
+		if err == nil && resp.Truncated {
+			client.Net = "tcp"
+			resp, _, err = client.ExchangeContext(ctx, m, resolver)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s on %s: %s", zone, resolver, err)
+	}
+
+	// Spoofed responses are unlikely to guess the exact case of the query
+	if c.Use0x20 && (len(resp.Question) == 0 || resp.Question[0].Name != m.Question[0].Name) {
+		return nil, fmt.Errorf("lookup %s on %s: response doesn't match the 0x20 encoded query %s", zone, resolver, m.Question[0].Name)
+	}
+
+	if c.DNSCookies {
+		cookies.store(resp, resolver)
+	}
+	return resp, nil
+}
+
+// randomCase randomizes the case of the letters in the given zone
+// to add more entropy to the queries (DNS 0x20 encoding)
+func randomCase(zone string) (string, error) {
+	random := make([]byte, len(zone))
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	b := []byte(strings.ToLower(zone))
+	for i := range b {
+		if b[i] >= 'a' && b[i] <= 'z' && random[i]&1 == 1 {
+			b[i] -= 'a' - 'A'
+		}
+	}
+	return string(b), nil
+}
+
+// isMDNSZone checks if the given zone should be resolved
+// using multicast DNS
+func isMDNSZone(zone string, c Config) bool {
+	return c.MDNS && strings.HasSuffix(strings.ToLower(zone), ".local.")
+}
+
+// queryMDNS sends a one-shot multicast DNS (RFC 6762) TXT query for the
+// given zone and returns the TXT records from the first matching answer
+func queryMDNS(zone string, ctx context.Context) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeTXT)
+	m.Id = 0
+	m.RecursionDesired = false
+	// Ask the responders for a unicast response
+	m.Question[0].Qclass |= 1 << 15
+
+	packed, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", mdnsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The responses come from the responder's own address,
+	// so the socket can't be connected to the multicast group
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(mdnsTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.WriteTo(packed, addr); err != nil {
+		return nil, fmt.Errorf("mDNS lookup %s: %s", zone, err)
+	}
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, fmt.Errorf("mDNS lookup %s: %s", zone, err)
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response {
+			continue
+		}
+
+		var txts []string
+		for _, rr := range resp.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && strings.EqualFold(txt.Hdr.Name, zone) {
+				txts = append(txts, strings.Join(txt.Txt, ""))
+			}
+		}
+		if len(txts) != 0 {
+			return txts, nil
+		}
+	}
+}
+
+// newQuery returns a query message for the given zone and type
+// with the class and EDNS0 options from the config
+func newQuery(zone string, qtype uint16, c Config) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, qtype)
+	if c.DNSClass != "" {
+		class, ok := dns.StringToClass[strings.ToUpper(c.DNSClass)]
+		if !ok {
+			return nil, fmt.Errorf("unknown DNS class %s", c.DNSClass)
+		}
+		m.Question[0].Qclass = class
+	}
+	size := uint16(ednsUDPSize)
+	if c.UDPBufferSize != 0 {
+		size = c.UDPBufferSize
+	}
+	m.SetEdns0(size, false)
+	return m, nil
+}
+
+// add attaches the COOKIE option to the given query. The client cookie is
+// generated once for each resolver and the server cookie is only sent
+// after the resolver returned one.
+func (j *cookieJar) add(m *dns.Msg, resolver string) {
+	j.Lock()
+	defer j.Unlock()
+
+	client, ok := j.client[resolver]
+	if !ok {
+		b := make([]byte, 8)
+		rand.Read(b)
+		client = hex.EncodeToString(b)
+		j.client[resolver] = client
+	}
+
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: client + j.server[resolver],
+	})
+}
+
+// store keeps the server cookie from the given response to use it in
+// the next queries sent to the same resolver
+func (j *cookieJar) store(m *dns.Msg, resolver string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	for _, option := range opt.Option {
+		cookie, ok := option.(*dns.EDNS0_COOKIE)
+		// The client cookie is 8 bytes, 16 characters in hex
+		if !ok || len(cookie.Cookie) <= 16 || cookie.Cookie[:16] != j.client[resolver] {
+			continue
+		}
+		j.server[resolver] = cookie.Cookie[16:]
+	}
+}
+
+// resolverAddr adds the given default port to the resolver
+// address if it doesn't have one
+func resolverAddr(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, port)
+	}
+	return addr
+}
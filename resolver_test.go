@@ -0,0 +1,549 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startDNSServer runs a DNS server with the given handler on a random
+// local port and returns its address. The network can be "udp" or "tcp".
+func startDNSServer(t *testing.T, network string, handler dns.HandlerFunc) string {
+	started := make(chan struct{})
+	server := &dns.Server{
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+
+	var addr string
+	if network == "tcp" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Couldn't start the DNS server: %s", err)
+		}
+		server.Listener, addr = l, l.Addr().String()
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Couldn't start the DNS server: %s", err)
+		}
+		server.PacketConn, addr = pc, pc.LocalAddr().String()
+	}
+
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return addr
+}
+
+// txtReply answers the given query with a single TXT record
+func txtReply(r *dns.Msg, txt string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{txt},
+	})
+	return m
+}
+
+func Test_queryDNSCookies(t *testing.T) {
+	const serverCookie = "0123456789abcdef"
+
+	var mu sync.Mutex
+	var received []string
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := txtReply(r, "v=txtv0;to=https://cookies.test")
+
+		if opt := r.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+					mu.Lock()
+					received = append(received, cookie.Cookie)
+					mu.Unlock()
+
+					m.SetEdns0(ednsUDPSize, false)
+					m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{
+						Code:   dns.EDNS0COOKIE,
+						Cookie: cookie.Cookie[:16] + serverCookie,
+					})
+				}
+			}
+		}
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver:   addr,
+		DNSCookies: true,
+	}
+	for i := 0; i < 2; i++ {
+		txts, err := query("_redirect.cookies.example.com.", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if txts[0] != "v=txtv0;to=https://cookies.test" {
+			t.Errorf("Unexpected TXT record: %s", txts[0])
+		}
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 queries with the COOKIE option, got %d", len(received))
+	}
+	if len(received[0]) != 16 {
+		t.Errorf("Expected the first query to only contain the client cookie, got %s", received[0])
+	}
+	if received[1] != received[0]+serverCookie {
+		t.Errorf("Expected the second query to contain the server cookie, got %s", received[1])
+	}
+}
+
+func Test_queryDNSClass(t *testing.T) {
+	var mu sync.Mutex
+	var class uint16
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		class = r.Question[0].Qclass
+		mu.Unlock()
+
+		m := txtReply(r, "v=txtv0;to=https://chaos.test")
+		m.Answer[0].Header().Class = r.Question[0].Qclass
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver: addr,
+		DNSClass: "CH",
+	}
+	txts, err := query("_redirect.chaos.example.com.", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://chaos.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+	if class != dns.ClassCHAOS {
+		t.Errorf("Expected the query class to be CH, got %s", dns.ClassToString[class])
+	}
+
+	c.DNSClass = "XY"
+	if _, err := query("_redirect.chaos.example.com.", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for an unknown DNS class")
+	}
+}
+
+func Test_queryMDNS(t *testing.T) {
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		q := r.Question[0]
+		// Only answer the queries asking for a unicast response
+		if q.Qclass&(1<<15) == 0 || q.Name != "_redirect.printer.local." {
+			return
+		}
+		m := txtReply(r, "v=txtv0;to=https://printer.test")
+		w.WriteMsg(m)
+	})
+
+	defaultAddr := mdnsAddr
+	mdnsAddr = addr
+	t.Cleanup(func() { mdnsAddr = defaultAddr })
+
+	c := Config{
+		MDNS: true,
+	}
+	txts, err := query("printer.local", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://printer.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+}
+
+func Test_queryUDPBufferSize(t *testing.T) {
+	// A single TXT record that doesn't fit in the default buffer size
+	var large []string
+	for i := 0; i < 10; i++ {
+		large = append(large, strings.Repeat("a", 255))
+	}
+
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := txtReply(r, "")
+		m.Answer[0].(*dns.TXT).Txt = large
+
+		// Truncate the answer if it exceeds the advertised buffer size
+		size := uint16(dns.MinMsgSize)
+		if opt := r.IsEdns0(); opt != nil {
+			size = opt.UDPSize()
+		}
+		if m.Len() > int(size) {
+			m.Answer = nil
+			m.Truncated = true
+		}
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver:      addr,
+		UDPBufferSize: 4096,
+	}
+	txts, err := query("_redirect.large.example.com.", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != strings.Join(large, "") {
+		t.Errorf("Expected the whole TXT record, got %d characters", len(txts[0]))
+	}
+
+	// The server only listens on UDP, so the TCP retry fails
+	c.UDPBufferSize = 1232
+	if _, err := query("_redirect.large.example.com.", context.Background(), c); err == nil {
+		t.Errorf("Expected the answer to be truncated with a %d bytes buffer", c.UDPBufferSize)
+	}
+}
+
+func Test_queryRetryOnEmpty(t *testing.T) {
+	var mu sync.Mutex
+	var queries int
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		queries++
+		first := queries%2 == 1
+		mu.Unlock()
+
+		// Answer every other query with an empty set
+		if first {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			w.WriteMsg(m)
+			return
+		}
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://retry.test"))
+	})
+
+	c := Config{
+		Resolver:     addr,
+		RetryOnEmpty: true,
+	}
+	txts, err := query("_redirect.retry.example.com.", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://retry.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+	if queries != 2 {
+		t.Errorf("Expected 2 queries, got %d", queries)
+	}
+}
+
+func Test_queryDNSClientParity(t *testing.T) {
+	zones := []string{
+		"_redirect.about.host.host.example.com.",
+		"_redirect.pkg.gometa.gometa.example.com.",
+		"_redirect.oversized.host.example.com.",
+	}
+	for _, zone := range zones {
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		}
+		stdlib, err := query(zone, context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error from net.Resolver: %s", err)
+		}
+
+		c.DNSClient = true
+		client, err := query(zone, context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error from the DNS client: %s", err)
+		}
+
+		sort.Strings(stdlib)
+		sort.Strings(client)
+		if !reflect.DeepEqual(stdlib, client) {
+			t.Errorf("Expected the DNS client to return %v for %s, got %v", stdlib, zone, client)
+		}
+	}
+}
+
+func Test_clientResolver(t *testing.T) {
+	f, err := ioutil.TempFile("", "resolv.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("search example.com\nnameserver 192.0.2.53\nnameserver 192.0.2.54\n")
+	f.Close()
+
+	defaultConf := resolvConf
+	resolvConf = f.Name()
+	t.Cleanup(func() { resolvConf = defaultConf })
+
+	tests := []struct {
+		resolver string
+		expected string
+	}{
+		{"", "192.0.2.53:53"},
+		{"127.0.0.1", "127.0.0.1:53"},
+		{"127.0.0.1:5353", "127.0.0.1:5353"},
+	}
+	for _, test := range tests {
+		addr, err := clientResolver(Config{Resolver: test.resolver})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if addr != test.expected {
+			t.Errorf("Expected resolver %s, got %s", test.expected, addr)
+		}
+	}
+}
+
+func Test_query0x20(t *testing.T) {
+	var mu sync.Mutex
+	var names []string
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		mu.Lock()
+		names = append(names, r.Question[0].Name)
+		mu.Unlock()
+
+		m := txtReply(r, "v=txtv0;to=https://mixed.test")
+		// Misbehaving resolvers lowercase the question
+		if strings.HasPrefix(strings.ToLower(r.Question[0].Name), "_redirect.lowercase.") {
+			m.Question[0].Name = strings.ToLower(r.Question[0].Name)
+		}
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver: addr,
+		Use0x20:  true,
+	}
+	for i := 0; i < 5; i++ {
+		txts, err := query("mixed.example.com", context.Background(), c)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if txts[0] != "v=txtv0;to=https://mixed.test" {
+			t.Errorf("Unexpected TXT record: %s", txts[0])
+		}
+	}
+
+	mixed := false
+	for _, name := range names {
+		if !strings.EqualFold(name, "_redirect.mixed.example.com.") {
+			t.Errorf("Unexpected query name %s", name)
+		}
+		if name != strings.ToLower(name) {
+			mixed = true
+		}
+	}
+	if !mixed {
+		t.Errorf("Expected mixed-case query names, got %v", names)
+	}
+
+	if _, err := query("lowercase.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for a response that doesn't preserve the case")
+	}
+}
+
+func Test_queryRetries(t *testing.T) {
+	var mu sync.Mutex
+	queries := map[string]int{}
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		name := r.Question[0].Name
+		mu.Lock()
+		queries[name]++
+		n := queries[name]
+		mu.Unlock()
+
+		m := new(dns.Msg)
+		switch {
+		case name == "_redirect.missing.example.com.":
+			m.SetRcode(r, dns.RcodeNameError)
+		case name == "_redirect.flaky.example.com." && n > 2:
+			m = txtReply(r, "v=txtv0;to=https://flaky.test")
+		default:
+			m.SetRcode(r, dns.RcodeServerFailure)
+		}
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver:          addr,
+		DNSClient:         true,
+		QueryRetryBackoff: time.Millisecond,
+	}
+	txts, err := query("flaky.example.com", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://flaky.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+	if n := queries["_redirect.flaky.example.com."]; n != 3 {
+		t.Errorf("Expected 3 queries, got %d", n)
+	}
+
+	_, err = query("broken.example.com", context.Background(), c)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("Expected an error after 3 attempts, got %v", err)
+	}
+
+	if _, err := query("missing.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for a missing zone")
+	}
+	if n := queries["_redirect.missing.example.com."]; n != 1 {
+		t.Errorf("Expected NXDOMAIN not to be retried, got %d queries", n)
+	}
+
+	c.QueryRetries = -1
+	if _, err := query("broken.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for a failing zone")
+	}
+	if n := queries["_redirect.broken.example.com."]; n != 4 {
+		t.Errorf("Expected a single query with the retries disabled, got %d more", n-3)
+	}
+}
+
+func Test_queryResolverRace(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://slow.test"))
+	})
+	fast := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://fast.test"))
+	})
+
+	c := Config{
+		Resolver:     slow,
+		Resolvers:    []string{fast},
+		ResolverRace: true,
+		DNSClient:    true,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	txts, err := query("race.example.com", ctx, c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://fast.test" {
+		t.Errorf("Expected the fast resolver's answer, got %s", txts[0])
+	}
+}
+
+func Test_queryFollowAliases(t *testing.T) {
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		name := r.Question[0].Name
+		alias := func(target string) *dns.CNAME {
+			return &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: target,
+			}
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch name {
+		case "_redirect.alias.example.com.":
+			m.Answer = append(m.Answer, alias("_redirect.apex.example.net."))
+		case "_redirect.apex.example.net.":
+			m = txtReply(r, "v=txtv0;to=https://apex.test")
+		case "_redirect.flattened.example.com.":
+			// The flattened TXT record keeps the owner name of the target
+			m = txtReply(r, "v=txtv0;to=https://flattened.test")
+			m.Answer[0].Header().Name = "_redirect.apex.example.net."
+		case "_redirect.loop.example.com.":
+			m.Answer = append(m.Answer, alias(name))
+		}
+		w.WriteMsg(m)
+	})
+
+	c := Config{
+		Resolver:     addr,
+		DNSClient:    true,
+		QueryRetries: -1,
+	}
+	if _, err := query("alias.example.com", context.Background(), c); err == nil {
+		t.Errorf("Expected an error for the alias without FollowAliases")
+	}
+
+	c.FollowAliases = true
+	tests := []struct {
+		zone string
+		txt  string
+		err  bool
+	}{
+		{zone: "alias.example.com", txt: "v=txtv0;to=https://apex.test"},
+		{zone: "flattened.example.com", txt: "v=txtv0;to=https://flattened.test"},
+		{zone: "loop.example.com", err: true},
+	}
+	for _, test := range tests {
+		txts, err := query(test.zone, context.Background(), c)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected an error for %s", test.zone)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.zone, err)
+			continue
+		}
+		if txts[0] != test.txt {
+			t.Errorf("Expected %s for %s, got %s", test.txt, test.zone, txts[0])
+		}
+	}
+}
+
+func Test_queryDNSTCPOnly(t *testing.T) {
+	// The server only listens on TCP, so the UDP queries don't get answered
+	addr := startDNSServer(t, "tcp", func(w dns.ResponseWriter, r *dns.Msg) {
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok {
+			t.Errorf("Expected the query over TCP, got %s", w.RemoteAddr().Network())
+		}
+		w.WriteMsg(txtReply(r, "v=txtv0;to=https://tcp.test"))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	c := Config{
+		Resolver:     addr,
+		QueryRetries: -1,
+	}
+	if _, err := query("tcponly.example.com", ctx, c); err == nil {
+		t.Errorf("Expected the UDP query to fail")
+	}
+
+	c.DNSTCPOnly = true
+	txts, err := query("tcponly.example.com", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://tcp.test" {
+		t.Errorf("Unexpected TXT record: %s", txts[0])
+	}
+}
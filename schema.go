@@ -0,0 +1,156 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// schemaField describes the constraints on a record field that are
+// checked when Config.SchemaValidate is enabled
+type schemaField struct {
+	name string
+	// set reports whether the field is present in the record
+	set func(rec Record) bool
+	// required are the record types that need the field
+	required []string
+	// types are the record types that can use the field, all of them if empty
+	types []string
+	// check validates the field's value if it's set
+	check func(rec Record) error
+}
+
+// recordSchema is the spec that the records are validated against on
+// top of ParseRecord's checks
+var recordSchema = []schemaField{
+	{
+		name:     "to",
+		set:      func(rec Record) bool { return rec.To != "" },
+		required: []string{"host", "gometa", "alias"},
+		check: func(rec Record) error {
+			// The gometa targets are repository roots without a scheme
+			if rec.Type == "gometa" {
+				return nil
+			}
+			return checkAbsoluteURL(rec.To)
+		},
+	},
+	{
+		name:  "root",
+		set:   func(rec Record) bool { return rec.Root != "" },
+		types: []string{"path"},
+		check: func(rec Record) error { return checkAbsoluteURL(rec.Root) },
+	},
+	{
+		name:  "website",
+		set:   func(rec Record) bool { return rec.Website != "" },
+		check: func(rec Record) error { return checkAbsoluteURL(rec.Website) },
+	},
+	{
+		name:  "code",
+		set:   func(rec Record) bool { return rec.Code != 0 },
+		check: func(rec Record) error { return checkRange(rec.Code, 300, 399) },
+	},
+	{
+		name:  "from",
+		set:   func(rec Record) bool { return rec.From != "" },
+		types: []string{"path", "gometa"},
+	},
+	{
+		name:  "re",
+		set:   func(rec Record) bool { return rec.Re != "" },
+		types: []string{"path"},
+	},
+	{
+		name:  "vcs",
+		set:   func(rec Record) bool { return rec.Vcs != "" },
+		types: []string{"gometa"},
+	},
+	{
+		name:  "rootredirect",
+		set:   func(rec Record) bool { return rec.RootRedirect != "" },
+		types: []string{"host"},
+	},
+	{
+		name:  "afterhours.to",
+		set:   func(rec Record) bool { return rec.AfterHoursTo != "" },
+		types: []string{"host"},
+	},
+	{
+		name:  "max-age",
+		set:   func(rec Record) bool { return rec.MaxAge != nil },
+		check: func(rec Record) error { return checkRange(*rec.MaxAge, 0, 31536000) },
+	},
+	{
+		name:  "refreshheader",
+		set:   func(rec Record) bool { return rec.Refresh != nil },
+		check: func(rec Record) error { return checkRange(*rec.Refresh, 0, 3600) },
+	},
+}
+
+// validateSchema checks the record against recordSchema and returns a
+// ValidationErrors with every field that doesn't match it. The records
+// that point to upstream zones are checked once they're resolved.
+func (rec Record) validateSchema() error {
+	if len(rec.Use) != 0 {
+		return nil
+	}
+	var errs ValidationErrors
+	for _, field := range recordSchema {
+		if !field.set(rec) {
+			if contains(field.required, rec.Type) {
+				errs = append(errs, fmt.Errorf("%s= field is required in %s type", field.name, rec.Type))
+			}
+			continue
+		}
+		if len(field.types) != 0 && !contains(field.types, rec.Type) {
+			errs = append(errs, fmt.Errorf("%s= field isn't allowed in %s type", field.name, rec.Type))
+			continue
+		}
+		if field.check == nil {
+			continue
+		}
+		if err := field.check(rec); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s= field: %s", field.name, err))
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkRange checks if n is between min and max inclusive
+func checkRange(n, min, max int) error {
+	if n < min || n > max {
+		return fmt.Errorf("%d is out of the range %d-%d", n, min, max)
+	}
+	return nil
+}
+
+// checkAbsoluteURL checks if target is an absolute http or https URL
+func checkAbsoluteURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s isn't an http or https URL", target)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%s doesn't have a host", target)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseRecordSchemaValidate(t *testing.T) {
+	tests := []struct {
+		record string
+		errs   []string
+	}{
+		{
+			record: "v=txtv0;to=https://example.com/;code=301;max-age=3600",
+		},
+		{
+			record: "v=txtv0;type=path;root=https://example.com/;from=/$1",
+		},
+		{
+			record: "v=txtv0;type=gometa;to=github.com/txtdirect/txtdirect;vcs=git",
+		},
+		{
+			record: "v=txtv0;use=_redirect.example.com",
+		},
+		{
+			record: "v=txtv0;type=gometa;vcs=hg",
+			errs:   []string{"to= field is required in gometa type"},
+		},
+		{
+			record: "v=txtv0;type=host;to=https://example.com/;vcs=git;from=/$1",
+			errs: []string{
+				"from= field isn't allowed in host type",
+				"vcs= field isn't allowed in host type",
+			},
+		},
+		{
+			record: "v=txtv0;to=example.com;website=ftp://example.com;max-age=63072000;refreshheader=7200",
+			errs: []string{
+				"invalid to= field: example.com isn't an http or https URL",
+				"invalid website= field: ftp://example.com isn't an http or https URL",
+				"invalid max-age= field: 63072000 is out of the range 0-31536000",
+				"invalid refreshheader= field: 7200 is out of the range 0-3600",
+			},
+		},
+	}
+	c := Config{
+		Enable:         []string{"host", "path", "gometa"},
+		SchemaValidate: true,
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/", nil)
+		resp := httptest.NewRecorder()
+		_, err := ParseRecord(test.record, resp, req, c)
+		if len(test.errs) == 0 {
+			if err != nil {
+				t.Errorf("Test %d: Unexpected error: %s", i, err)
+			}
+			continue
+		}
+		var errs ValidationErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("Test %d: Expected ValidationErrors, got %v", i, err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), "record doesn't match the schema: ") {
+			t.Errorf("Test %d: Unexpected error message: %s", i, err)
+		}
+		if len(errs) != len(test.errs) {
+			t.Errorf("Test %d: Expected %d errors, got %d: %s", i, len(test.errs), len(errs), err)
+			continue
+		}
+		for j, expected := range test.errs {
+			if errs[j].Error() != expected {
+				t.Errorf("Test %d: Expected error %q, got %q", i, expected, errs[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// WeightedTarget is one of the targets in a to= list
+type WeightedTarget struct {
+	URL    string
+	Weight int
+	// Origin is the scheme and host the health checks are keyed on.
+	// It's empty if they depend on the request.
+	Origin string
+}
+
+// weightRegex matches the record fields that start with the weight of
+// a to= list entry, since the record is split on ";" before parsing
+var weightRegex = regexp.MustCompile(`^\d+(,|$)`)
+
+// joinWeightedTargets joins the weights of the to= list entries like
+// "to=https://a.example;3,https://b.example;1" back into the to= field
+func joinWeightedTargets(fields []string) []string {
+	var joined []string
+	for _, field := range fields {
+		last := len(joined) - 1
+		if last >= 0 && strings.HasPrefix(joined[last], "to=") && weightRegex.MatchString(field) {
+			joined[last] += ";" + field
+			continue
+		}
+		joined = append(joined, field)
+	}
+	return joined
+}
+
+// parseTargets parses a to= value with a comma separated list of targets
+// and their optional weights. It returns nil for a single target without
+// a weight, so these records keep working the same way as before.
+// The value still has its escapes, so "\;" isn't taken as a weight.
+func parseTargets(value string) ([]WeightedTarget, error) {
+	entries := strings.Split(value, ",")
+	if len(splitEscaped(value, ';')) == 1 {
+		if len(entries) == 1 {
+			return nil, nil
+		}
+		// Commas are allowed in a single target's path and query
+		for _, entry := range entries {
+			if !strings.Contains(entry, "://") {
+				return nil, nil
+			}
+		}
+	}
+
+	var targets []WeightedTarget
+	for _, entry := range entries {
+		target := WeightedTarget{URL: unescape(entry), Weight: 1}
+		if parts := splitEscaped(entry, ';'); len(parts) > 1 {
+			i := len(entry) - len(parts[len(parts)-1]) - 1
+			weight, err := strconv.Atoi(entry[i+1:])
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid weight for %s: %s", unescape(entry[:i]), entry[i+1:])
+			}
+			target = WeightedTarget{URL: unescape(entry[:i]), Weight: weight}
+		}
+		if !strings.Contains(target.URL, "://") {
+			return nil, fmt.Errorf("invalid target in the to= list: %s", target.URL)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// selectTarget picks one of the given targets with a source seeded for
+// the current request, so concurrent requests don't share the source
+func selectTarget(targets []WeightedTarget) string {
+	return pickTarget(targets, rand.New(rand.NewSource(now().UnixNano())))
+}
+
+// pickTarget selects one of the given targets randomly based on the weights
+func pickTarget(targets []WeightedTarget, rnd *rand.Rand) string {
+	total := 0
+	for _, target := range targets {
+		total += target.Weight
+	}
+	n := rnd.Intn(total)
+	for _, target := range targets {
+		if n < target.Weight {
+			return target.URL
+		}
+		n -= target.Weight
+	}
+	return targets[len(targets)-1].URL
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"math"
+	"math/rand"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseRecordTargets(t *testing.T) {
+	tests := []struct {
+		txtRecord string
+		to        string
+		targets   []WeightedTarget
+		err       bool
+	}{
+		{
+			txtRecord: "v=txtv0;to=https://a.example",
+			to:        "https://a.example",
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example/?list=1,2",
+			to:        "https://a.example/?list=1,2",
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example;3,https://b.example;1;code=302",
+			to:        "https://a.example",
+			targets: []WeightedTarget{
+				{URL: "https://a.example", Weight: 3, Origin: "https://a.example"},
+				{URL: "https://b.example", Weight: 1, Origin: "https://b.example"},
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example,https://b.example",
+			to:        "https://a.example",
+			targets: []WeightedTarget{
+				{URL: "https://a.example", Weight: 1, Origin: "https://a.example"},
+				{URL: "https://b.example", Weight: 1, Origin: "https://b.example"},
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example/?x=1\\;y=2;3,https://b.example;1",
+			to:        "https://a.example/?x=1;y=2",
+			targets: []WeightedTarget{
+				{URL: "https://a.example/?x=1;y=2", Weight: 3, Origin: "https://a.example"},
+				{URL: "https://b.example", Weight: 1, Origin: "https://b.example"},
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example/;3,https://b.example/;1;scheme=http",
+			to:        "http://a.example/",
+			targets: []WeightedTarget{
+				{URL: "http://a.example/", Weight: 3, Origin: "http://a.example"},
+				{URL: "http://b.example/", Weight: 1, Origin: "http://b.example"},
+			},
+		},
+		{
+			txtRecord: "v=txtv0;to=https://a.example;0,https://b.example;1",
+			err:       true,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.com", nil)
+		w := httptest.NewRecorder()
+		rec, err := ParseRecord(test.txtRecord, w, req, Config{Enable: []string{"host"}})
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if rec.To != test.to {
+			t.Errorf("Test %d: Expected to= to be %s, got %s", i, test.to, rec.To)
+		}
+		if !reflect.DeepEqual(rec.Targets, test.targets) {
+			t.Errorf("Test %d: Expected targets %v, got %v", i, test.targets, rec.Targets)
+		}
+	}
+}
+
+func TestRedirectTargetsNonce(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+		NonceKey: "secret",
+	}
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest("GET", "https://weighted.host.example.com/", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error occured: %s", err.Error())
+		}
+		location, err := url.Parse(resp.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Couldn't parse the Location header: %s", err)
+		}
+		if location.Scheme != "http" {
+			t.Errorf("Expected the scheme= field to apply to %s", location)
+		}
+		if location.Query().Get("nonce") == "" {
+			t.Errorf("Expected the nonce to be added to %s", location)
+		}
+	}
+}
+
+func Test_pickTargetDistribution(t *testing.T) {
+	targets := []WeightedTarget{
+		{URL: "https://a.example", Weight: 3},
+		{URL: "https://b.example", Weight: 1},
+		{URL: "https://c.example", Weight: 6},
+	}
+	const iterations = 100000
+	rnd := rand.New(rand.NewSource(1))
+
+	counts := map[string]int{}
+	for i := 0; i < iterations; i++ {
+		counts[pickTarget(targets, rnd)]++
+	}
+	for _, target := range targets {
+		expected := float64(target.Weight) / 10
+		got := float64(counts[target.URL]) / iterations
+		if math.Abs(got-expected) > 0.01 {
+			t.Errorf("Expected %s to be picked %.2f of the time, got %.3f", target.URL, expected, got)
+		}
+	}
+}
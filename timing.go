@@ -0,0 +1,66 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timings keeps the time spent on each step of the request resolution
+type Timings struct {
+	mu    sync.Mutex
+	dns   time.Duration
+	parse time.Duration
+}
+
+// String returns the timings in the Server-Timing header format
+func (t *Timings) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("dns;dur=%.2f, parse;dur=%.2f", milliseconds(t.dns), milliseconds(t.parse))
+}
+
+// addTimings adds a fresh Timings instance to the request's context
+// with "timings" key
+func addTimings(r *http.Request) (*http.Request, *Timings) {
+	t := &Timings{}
+	return r.WithContext(context.WithValue(r.Context(), "timings", t)), t
+}
+
+// trackTiming adds the time passed since start to the given step of the
+// Timings instance in the context. It does nothing if timings aren't tracked.
+func trackTiming(ctx context.Context, step string, start time.Time) {
+	t, ok := ctx.Value("timings").(*Timings)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch step {
+	case "dns":
+		t.dns += elapsed
+	case "parse":
+		t.parse += elapsed
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
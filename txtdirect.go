@@ -14,11 +14,18 @@ limitations under the License.
 package txtdirect
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -32,6 +39,7 @@ const (
 	fallbackDelay     = 300 * time.Millisecond
 	proxyTimeout      = 30 * time.Second
 	Status301CacheAge = 604800
+	maxAliasChain     = 10
 )
 
 var bl = map[string]bool{
@@ -42,9 +50,55 @@ var bl = map[string]bool{
 func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	w.Header().Set("Server", "TXTDirect")
 
+	if c.ServerTiming {
+		var timings *Timings
+		r, timings = addTimings(r)
+		w = addHeaderHook(w, func(int) {
+			w.Header().Set("Server-Timing", timings.String())
+		})
+	}
+
+	// The aliases resolved by the nested Redirect calls keep the same chain
+	if c.DebugHeaders && r.Context().Value("recordChain") == nil {
+		var chain *recordChain
+		r, chain = addRecordChain(r)
+		w = addHeaderHook(w, func(int) {
+			if hops := chain.String(); hops != "" {
+				w.Header().Set("X-TXTDirect-Chain", hops)
+			}
+		})
+	}
+
+	// The host is looked up, matched and logged in its normalized form
+	r.Host = normalizeHost(r.Host, c)
+
+	var rec Record
+	if c.OnRedirect != nil {
+		start := time.Now()
+		var status int
+		w = addHeaderHook(w, func(code int) {
+			status = code
+		})
+		defer func() {
+			if !isRedirect(status) {
+				return
+			}
+			c.OnRedirect(RedirectEvent{
+				Host:     r.Host,
+				Target:   w.Header().Get("Location"),
+				Type:     rec.Type,
+				Code:     status,
+				Duration: time.Since(start),
+			})
+		}()
+	}
+
 	host := r.Host
 	path := r.URL.Path
 
+	// The per-host enabled types replace the global ones for the whole request
+	c.Enable = c.enabledTypes(host)
+
 	if c.Qr.Enable {
 		// Return the Qr code for the URI if "qr" query is available
 		if _, ok := r.URL.Query()["qr"]; ok {
@@ -58,20 +112,29 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	}
 
 	if isIP(host) {
-		log.Println("[txtdirect]: Trying to access 127.0.0.1, fallback triggered.")
+		logFallback(c, r, "", "%s is an IP address", host)
 		fallback(w, r, "global", http.StatusMovedPermanently, c)
 		return nil
 	}
 
 	rec, err := GetRecord(host, c, w, r)
+	if errors.Is(err, ErrMissingTarget) {
+		logFallback(c, r, "host", "the record doesn't have a to= target")
+		fallback(w, r, "global", http.StatusMovedPermanently, c)
+		return nil
+	}
 	if err != nil {
+		logFallback(c, r, "", "the record couldn't be resolved: %s", err.Error())
+		if isNotFound(err) && notFoundFallback(w, r, c) {
+			return nil
+		}
 		fallback(w, r, "global", http.StatusFound, c)
 		return nil
 	}
 
 	// Add the upstream zone address from the use= fields to the request context
 	if r, err = rec.CheckUpstream(w, r, c); err != nil {
-		log.Printf("[txtdirect]: Couldn't fetch the upstream record: %s", err.Error())
+		logf(c, r, "Couldn't fetch the upstream record: %s", err.Error())
 		fallback(w, r, "global", http.StatusFound, c)
 		return nil
 	}
@@ -89,11 +152,57 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	}
 
 	if !contains(c.Enable, rec.Type) {
-		return fmt.Errorf("type \"%s\" is not enabled. Enabled types are: %v", rec.Type, c.Enable)
+		logFallback(c, r, rec.Type, "type \"%s\" is not enabled. Enabled types are: %v", rec.Type, c.Enable)
+		fallback(w, r, "global", http.StatusFound, c)
+		return nil
+	}
+
+	// Continue the resolution with the aliased zone's own record
+	if rec.Type == "alias" {
+		return aliasRedirect(w, r, rec, c)
+	}
+
+	// Deny the requests that aren't referred from the record's referer= host
+	if rec.Referer != "" && !validReferer(r, rec.Referer) {
+		logf(c, r, "Request to %s is denied because its Referer doesn't match %s", r.Host+r.URL.Path, rec.Referer)
+		w.Header().Add("Status-Code", strconv.Itoa(http.StatusForbidden))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil
+	}
+
+	// Only apply the record to the requests coming from the fromscheme= scheme
+	if rec.FromScheme != "" && requestScheme(r, c) != rec.FromScheme {
+		logFallback(c, r, rec.Type, "%s requests aren't allowed, the record requires %s", requestScheme(r, c), rec.FromScheme)
+		fallback(w, r, "global", http.StatusFound, c)
+		return nil
+	}
+
+	// Only apply the record when its flag= feature flag is on
+	if rec.Flag != "" && (c.FlagEvaluator == nil || !c.FlagEvaluator(rec.Flag, r)) {
+		logFallback(c, r, rec.Type, "the %s flag is off", rec.Flag)
+		fallback(w, r, "global", http.StatusFound, c)
+		return nil
+	}
+
+	// Outside of the hours= window the afterhours.to= target is used
+	// instead of to=, including the to= lists. ParseRecord makes sure
+	// the records with hours= have an afterhours.to= target.
+	if rec.Hours != nil && !rec.Hours.Contains(now()) {
+		rec.To = rec.AfterHoursTo
+		rec.Targets = nil
+	}
+
+	// The lang.<tag>= targets are used for the clients that accept them
+	if len(rec.Languages) != 0 {
+		w.Header().Add("Vary", "Accept-Language")
+		if to, ok := rec.languageTarget(r); ok {
+			rec.To = to
+			rec.Targets = nil
+		}
 	}
 
 	if rec.Re != "" && rec.From != "" {
-		log.Println("[txtdirect]: It's not allowed to use both re= and from= in a record.")
+		logFallback(c, r, rec.Type, "it's not allowed to use both re= and from= in a record")
 		fallback(w, r, "to", rec.Code, c)
 		return nil
 	}
@@ -105,6 +214,11 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 			return path.RedirectRoot()
 		}
 
+		// Rewrite the path within the record if to= uses the re= capture groups
+		if rec.Regexp != nil && hasCaptureGroups(rec.To) {
+			return path.RedirectRegex()
+		}
+
 		if path.path != "" && rec.Re != "record" {
 			record := path.Redirect()
 			// It means fallback got triggered, If record is nil
@@ -118,7 +232,7 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		if path.rec.Re == "record" {
 			record, err := path.SpecificRecord()
 			if err != nil {
-				log.Printf("[txtdirect]: Fallback is triggered because redirect to the most specific match failed: %s", err.Error())
+				logFallback(c, r, rec.Type, "redirect to the most specific match failed: %s", err.Error())
 				fallback(path.rw, path.req, "to", path.rec.Code, path.c)
 				return nil
 			}
@@ -126,7 +240,40 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		}
 	}
 
+	// Pick one of the host record's to= targets before the nonce is added
+	if rec.Type == "host" && len(rec.Targets) != 0 {
+		if c.HealthCheckInterval > 0 {
+			health.watch(rec.Targets, c)
+			to, ok := health.firstHealthy(rec.Targets)
+			if !ok {
+				logFallback(c, r, rec.Type, "all of the targets of %s are down", r.Host)
+				fallback(w, r, "global", http.StatusFound, c)
+				return nil
+			}
+			rec.To = to
+		} else {
+			rec.To = selectTarget(rec.Targets)
+		}
+	}
+
+	if rec.Nonce {
+		if rec.To, err = addNonce(rec.To, c.NonceKey); err != nil {
+			logf(c, r, "Couldn't add the nonce to the target: %s", err.Error())
+			fallback(w, r, "global", http.StatusFound, c)
+			return nil
+		}
+	}
+
 	if rec.Type == "host" {
+		// Only redirect to the targets reachable over the family= IP version
+		if rec.Family != 0 {
+			ok, err := targetHasFamily(r.Context(), rec.To, rec.Family, c)
+			if err != nil || !ok {
+				logFallback(c, r, rec.Type, "%s has no IPv%d address: %v", rec.To, rec.Family, err)
+				fallback(w, r, "global", http.StatusFound, c)
+				return nil
+			}
+		}
 		host := NewHost(w, r, rec, c)
 
 		if err := host.Redirect(); err != nil {
@@ -146,7 +293,44 @@ func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
 		return gometa.Serve()
 	}
 
-	return fmt.Errorf("record type %s unsupported", rec.Type)
+	// Unknown types, e.g. from records written for a newer TXTDirect
+	// version, degrade to the fallback instead of an internal error
+	logFallback(c, r, rec.Type, "record type \"%s\" is not supported", rec.Type)
+	fallback(w, r, "global", http.StatusFound, c)
+	return nil
+}
+
+// aliasRedirect runs Redirect again for the host in the alias record's
+// to= field. The number of aliases followed for the request is kept in
+// its context to stop the alias cycles.
+func aliasRedirect(w http.ResponseWriter, r *http.Request, rec Record, c Config) error {
+	depth, _ := r.Context().Value("aliasDepth").(int)
+	if depth >= maxAliasChain {
+		logFallback(c, r, rec.Type, "%s exceeded the maximum of %d chained aliases", r.Host, maxAliasChain)
+		fallback(w, r, "global", http.StatusFound, c)
+		return nil
+	}
+
+	host := rec.To
+	if strings.Contains(host, "://") {
+		u, err := url.Parse(host)
+		if err != nil {
+			logFallback(c, r, rec.Type, "alias target %s is invalid: %s", rec.To, err.Error())
+			fallback(w, r, "global", http.StatusFound, c)
+			return nil
+		}
+		host = u.Host
+	}
+
+	// The aliased zone starts a new chain of records
+	ctx := context.WithValue(r.Context(), "aliasDepth", depth+1)
+	ctx = context.WithValue(ctx, "records", nil)
+	aliased := r.WithContext(ctx)
+	aliased.Host = host
+
+	// The redirect event is only reported once by the first Redirect call
+	c.OnRedirect = nil
+	return Redirect(w, aliased, c)
 }
 
 // UpstreamZone returns the upstream zone from request's context
@@ -164,11 +348,185 @@ func customResolver(c Config) net.Resolver {
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			d := net.Dialer{}
+			if resolverProtocol(c) == "tcp" {
+				network = "tcp"
+			}
 			return d.DialContext(ctx, network, c.Resolver)
 		},
 	}
 }
 
+// targetHasFamily checks if the host of the given target has an address
+// of the given IP family, either 4 or 6
+func targetHasFamily(ctx context.Context, target string, family int, c Config) (bool, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		resolver := net.DefaultResolver
+		if c.Resolver != "" && contains([]string{"", "udp", "tcp"}, c.ResolverProtocol) {
+			custom := customResolver(c)
+			resolver = &custom
+		}
+		addrs, err := resolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == 4) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validReferer checks if the request's Referer header points to the
+// given host or one of its subdomains
+func validReferer(r *http.Request, host string) bool {
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Hostname() == "" {
+		return false
+	}
+	refHost := strings.ToLower(referer.Hostname())
+	return refHost == host || strings.HasSuffix(refHost, "."+host)
+}
+
+// addNonce appends a random nonce and its HMAC-SHA256 signature to the
+// given target as the "nonce" query. The query value is formatted as
+// "<nonce>.<signature>" so the backend can verify it using the same key.
+func addNonce(target, key string) (string, error) {
+	to, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(nonce))
+
+	query := to.Query()
+	query.Set("nonce", nonce+"."+hex.EncodeToString(mac.Sum(nil)))
+	to.RawQuery = query.Encode()
+	return to.String(), nil
+}
+
+// redirectWithReason writes a redirect response with a custom reason
+// phrase in the status line. net/http always uses the standard reason
+// phrases, so the connection gets hijacked to write the response.
+// A hijacked connection can't be handed back to the server, so it's
+// closed after the response and these redirects always send
+// "Connection: close". It returns an error if the connection can't be
+// hijacked, e.g. on HTTP/2.
+func redirectWithReason(w http.ResponseWriter, location string, code int, reason string) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("the response writer doesn't support hijacking")
+	}
+
+	// The wrapping writers can't tell if the writer underneath supports
+	// hijacking, so the headers are only set once it succeeded. The
+	// http.Redirect fallback would send them along otherwise.
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Length", "0")
+	w.Header().Set("Connection", "close")
+
+	// Let the wrapping writers add their headers and see the status code
+	prepareHeader(w, code)
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", code, reason)
+	w.Header().Write(buf)
+	buf.WriteString("\r\n")
+	return buf.Flush()
+}
+
+// requestScheme returns the scheme of the incoming request. Requests
+// behind a TLS terminating proxy are detected using X-Forwarded-Proto,
+// which is only honored if the request comes from a trusted proxy since
+// any client can set it.
+func requestScheme(r *http.Request, c Config) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && trustedProxy(r.RemoteAddr, c) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	return "http"
+}
+
+// trustedProxy checks if the given remote address is one of the
+// config's TrustedProxies
+func trustedProxy(remoteAddr string, c Config) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range c.TrustedProxies {
+		network, err := parseTrustedProxy(proxy)
+		if err != nil {
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy parses the given IP or CIDR from TrustedProxies
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if strings.Contains(proxy, "/") {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s: %s", proxy, err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid trusted proxy %s", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// trimTrailingDot removes the trailing dot from the given host
+// while keeping the port intact
+func trimTrailingDot(host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimSuffix(h, "."), port)
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
 func isIP(host string) bool {
 	if v6slice := strings.Split(host, ":"); len(v6slice) > 2 {
 		return true
@@ -182,7 +540,7 @@ func blacklistRedirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	if bl[r.URL.Path] {
 		redirect := strings.Join([]string{r.Host, r.URL.Path}, "")
 
-		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, redirect)
+		logRedirect(c, r, "", redirect, http.StatusNotFound)
 		// Empty Content-Type to prevent http.Redirect from writing an html response body
 		w.Header().Set("Content-Type", "")
 		w.Header().Add("Status-Code", strconv.Itoa(http.StatusNotFound))
@@ -191,6 +549,75 @@ func blacklistRedirect(w http.ResponseWriter, r *http.Request, c Config) error {
 	return nil
 }
 
+// writeBody writes the given body to the response. The body gets gzipped
+// if it's larger than the given threshold and the client accepts gzip.
+// A zero threshold disables compression. Responses carry an ETag and
+// requests with a matching If-None-Match get a 304 without the body.
+func writeBody(w http.ResponseWriter, r *http.Request, body []byte, threshold int) error {
+	compressible := threshold > 0 && len(body) > threshold
+	compress := compressible && acceptsGzip(r)
+
+	if compressible {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	etag := bodyETag(body, compress)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	if !compress {
+		_, err := w.Write(body)
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(body); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bodyETag returns a strong ETag for the given body. Gzipped responses
+// get a different ETag than the identity encoded ones.
+func bodyETag(body []byte, gzipped bool) string {
+	sum := sha1.Sum(body)
+	if gzipped {
+		return fmt.Sprintf("\"%x-gzip\"", sum)
+	}
+	return fmt.Sprintf("\"%x\"", sum)
+}
+
+// etagMatch checks if the given If-None-Match header value matches the ETag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip checks the request's Accept-Encoding header for gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if name := strings.TrimSpace(params[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		// Explicitly refused with a zero quality value
+		if len(params) > 1 && strings.TrimSpace(params[1]) == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
 // contains checks the given slice to see if an item exists
 // in that slice or not
 func contains(array []string, word string) bool {
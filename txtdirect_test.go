@@ -15,12 +15,20 @@ package txtdirect
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"log"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -31,14 +39,68 @@ var txts = map[string]string{
 	"_redirect.host.host.example.com.": "v=txtv0;to=https://plain.host.test;type=host;ref=true;>TestHeader=TestValue;code=302",
 
 	// type=path
-	"_redirect.path.path.example.com.": "v=txtv0;type=path;>TestHeader=TestValue;>TestHeader1=TestValue1",
-	"_redirect.host.path.example.com.": "v=txtv0;type=host;to=https://host.host.example.com;",
+	"_redirect.path.path.example.com.":    "v=txtv0;type=path;>TestHeader=TestValue;>TestHeader1=TestValue1",
+	"_redirect.host.path.example.com.":    "v=txtv0;type=host;to=https://host.host.example.com;",
+	"_redirect.rewrite.path.example.com.": "v=txtv0;type=path;re=^/docs/([a-z]+)/([0-9]+)$;to=https://docs.test/v$2/$1",
+
+	// disabled types behind an upstream record
+	"_redirect.disabled.host.example.com.":          "v=txtv0;use=_redirect.upstream.disabled.host.example.com",
+	"_redirect.upstream.disabled.host.example.com.": "v=txtv0;type=gometa;to=https://pkg.txtdirect.org;use=_redirect.gometa.gometa.example.com",
+
+	// record types unknown to this version
+	"_redirect.unknown.host.example.com.": "v=txtv0;to=https://unknown.host.test;type=future",
+
+	// referer= restricted records
+	"_redirect.referer.host.example.com.": "v=txtv0;to=https://referer.host.test;referer=example.com",
+
+	// fromscheme= restricted records
+	"_redirect.tls.host.example.com.":            "v=txtv0;to=https://tls.host.test;fromscheme=https",
+	"_redirect.hours.host.example.com.":          "v=txtv0;to=https://support.test;hours=09:00-17:00/America/New_York;afterhours.to=https://afterhours.test",
+	"_redirect.hours.weighted.host.example.com.": "v=txtv0;to=https://a.support.test,https://b.support.test;hours=09:00-17:00/America/New_York;afterhours.to=https://afterhours.test/;scheme=http",
+
+	// IP family restricted targets
+	"_redirect.v4only.host.example.com.": "v=txtv0;to=https://192.0.2.1/;family=6",
+	"_redirect.v6.host.example.com.":     "v=txtv0;to=https://[2001:db8::1]/;family=6",
+
+	// feature flagged records
+	"_redirect.flag.host.example.com.": "v=txtv0;to=https://new-checkout.test;flag=new-checkout",
+
+	// alias records
+	"_redirect.alias.host.example.com.":   "v=txtv0;type=alias;to=aliased.host.example.com",
+	"_redirect.aliased.host.example.com.": "v=txtv0;to=https://aliased.host.test;code=302",
+	"_redirect.loop1.host.example.com.":   "v=txtv0;type=alias;to=https://loop2.host.example.com",
+	"_redirect.loop2.host.example.com.":   "v=txtv0;type=alias;to=loop1.host.example.com",
+
+	// localized records
+	"_redirect.lang.host.example.com.": "v=txtv0;to=https://example.test;lang.fr=https://fr.example.test;lang.pt-BR=https://br.example.test",
+
+	// method preserving redirects
+	"_redirect.api.host.example.com.": "v=txtv0;to=https://api.host.test/v2;code=307",
+
+	// signed nonce targets
+	"_redirect.nonce.host.example.com.":    "v=txtv0;to=https://nonce.host.test/?id=1;nonce=true",
+	"_redirect.weighted.host.example.com.": "v=txtv0;to=https://a.host.test/,https://b.host.test/;scheme=http;nonce=true",
+	"_redirect.reason.host.example.com.":   "v=txtv0;to=https://reason.host.test;code=302;reason=Moved to new home",
+
+	// record-driven response headers
+	"_redirect.headers.host.example.com.":    "v=txtv0;to=https://headers.host.test;robots=noindex,nofollow;permissionspolicy=geolocation=(), camera=();documentpolicy=force-load-at-top, oversized-images=2.0;sunset=2025-12-31T00:00:00Z;corp=same-origin;clearsitedata=cookies,storage",
+	"_redirect.preconnect.host.example.com.": "v=txtv0;to=https://preconnect.host.test;preconnect=https://cdn.example.com;preconnect=https://fonts.example.com",
+	"_redirect.frame.gometa.example.com.":    "v=txtv0;to=https://git.example.test/frame;type=gometa;frameoptions=deny",
 
 	// query() function test records
 	"_redirect.about.host.host.example.com.":   "v=txtv0;to=https://about.txtdirect.org",
 	"_redirect.pkg.gometa.gometa.example.com.": "v=txtv0;to=https://pkg.txtdirect.org;type=gometa",
 }
 
+// Testing zones with more than one TXT record
+var txtSets = map[string][]string{
+	"_redirect.oversized.host.example.com.": {
+		"v=txtv0;to=https://1.host.test", "v=txtv0;to=https://2.host.test",
+		"v=txtv0;to=https://3.host.test", "v=txtv0;to=https://4.host.test",
+		"v=txtv0;to=https://5.host.test", "v=txtv0;to=https://6.host.test",
+	},
+}
+
 // Testing DNS server port
 const port = 6000
 
@@ -46,7 +108,16 @@ const port = 6000
 var server = &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
 
 func TestMain(m *testing.M) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go RunDNSServer()
+
+	// Wait for the DNS server before running tests that query it
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		log.Println("DNS server didn't start in time")
+	}
 	os.Exit(m.Run())
 }
 
@@ -92,34 +163,138 @@ func Test_query(t *testing.T) {
 	}
 }
 
-func parseDNSQuery(m *dns.Msg) {
+func Test_queryMaxTXTAnswers(t *testing.T) {
+	zone := "_redirect.oversized.host.example.com."
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+
+	txts, err := query(zone, context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(txts) != len(txtSets[zone]) {
+		t.Errorf("Expected %d records, got %d", len(txtSets[zone]), len(txts))
+	}
+
+	c.MaxTXTAnswers = 5
+	if _, err := query(zone, context.Background(), c); err == nil {
+		t.Errorf("Expected an error for a zone with more than %d records", c.MaxTXTAnswers)
+	}
+}
+
+func Test_queryMaxConcurrentQueries(t *testing.T) {
+	zone := "_redirect.about.host.host.example.com."
+	c := Config{
+		Resolver:             "127.0.0.1:" + strconv.Itoa(port),
+		MaxConcurrentQueries: 2,
+	}
+
+	// Take all the slots to simulate the in-flight queries
+	var releases []func()
+	for i := 0; i < c.MaxConcurrentQueries; i++ {
+		release, err := acquireQuerySlot(context.Background(), c.MaxConcurrentQueries)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		releases = append(releases, release)
+	}
+
+	if _, err := query(zone, context.Background(), c); err == nil {
+		t.Errorf("Expected an error when all the %d query slots are taken", c.MaxConcurrentQueries)
+	}
+
+	releases[0]()
+	if _, err := query(zone, context.Background(), c); err != nil {
+		t.Errorf("Unexpected error after releasing a query slot: %s", err)
+	}
+	releases[1]()
+}
+
+func Test_querySecondaryResolver(t *testing.T) {
+	zone := "_redirect.about.host.host.example.com."
+	tests := []struct {
+		rcode   int
+		cookies bool
+		found   bool
+	}{
+		{rcode: dns.RcodeNameError, found: true},
+		{rcode: dns.RcodeNameError, cookies: true, found: true},
+		{rcode: dns.RcodeServerFailure, found: false},
+		{rcode: dns.RcodeServerFailure, cookies: true, found: false},
+	}
+	for i, test := range tests {
+		rcode := test.rcode
+		primary := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetRcode(r, rcode)
+			w.WriteMsg(m)
+		})
+		c := Config{
+			Resolver:          primary,
+			SecondaryResolver: "127.0.0.1:" + strconv.Itoa(port),
+			DNSCookies:        test.cookies,
+		}
+
+		resp, err := query(zone, context.Background(), c)
+		if !test.found {
+			if err == nil {
+				t.Errorf("Test %d: Expected the secondary resolver to be skipped on %s", i, dns.RcodeToString[rcode])
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if resp[0] != txts[zone] {
+			t.Errorf("Test %d: Expected %s, got %s", i, txts[zone], resp[0])
+		}
+	}
+}
+
+// parseDNSQuery answers the TXT questions of m from the given
+// zone-to-TXT map. Unknown zones get an empty TXT record.
+func parseDNSQuery(m *dns.Msg, records map[string]string) {
 	for _, q := range m.Question {
 		switch q.Qtype {
 		case dns.TypeTXT:
 			log.Printf("Query for %s\n", q.Name)
+			if set, ok := txtSets[q.Name]; ok {
+				for _, txt := range set {
+					m.Answer = append(m.Answer, &dns.TXT{
+						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+						Txt: []string{txt},
+					})
+				}
+				continue
+			}
 			m.Answer = append(m.Answer, &dns.TXT{
 				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
-				Txt: []string{txts[q.Name]},
+				Txt: []string{records[q.Name]},
 			})
 		}
 	}
 }
 
-func handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
-	m := new(dns.Msg)
-	m.SetReply(r)
-	m.Compress = false
+// txtHandler serves the given zone-to-TXT map, so the tests can start
+// a DNS server with their own zones using startDNSServer
+func txtHandler(records map[string]string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Compress = false
 
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		parseDNSQuery(m)
-	}
+		switch r.Opcode {
+		case dns.OpcodeQuery:
+			parseDNSQuery(m, records)
+		}
 
-	w.WriteMsg(m)
+		w.WriteMsg(m)
+	}
 }
 
 func RunDNSServer() {
-	dns.HandleFunc("example.com.", handleDNSRequest)
+	dns.HandleFunc("example.com.", txtHandler(txts))
 	err := server.ListenAndServe()
 	defer server.Shutdown()
 	if err != nil {
@@ -352,3 +527,589 @@ func Test_getBaseTarget(t *testing.T) {
 		}
 	}
 }
+
+func TestRedirectTrailingDot(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{
+			host:     "host.host.example.com.",
+			expected: "https://plain.host.test",
+		},
+		{
+			host:     "host.host.example.com.:8080",
+			expected: "https://plain.host.test",
+		},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "https://host.host.example.com/", nil)
+		req.Host = test.host
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Unexpected error occured: %s", err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.host, test.expected, location)
+		}
+	}
+}
+
+func Test_trimTrailingDot(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com.", "example.com"},
+		{"example.com", "example.com"},
+		{"example.com.:443", "example.com:443"},
+		{"[::1]:80", "[::1]:80"},
+	}
+	for _, test := range tests {
+		if result := trimTrailingDot(test.host); result != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, result)
+		}
+	}
+}
+
+func TestRedirectDisabledType(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://disabled.host.example.com/", nil)
+	resp := httptest.NewRecorder()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+		Redirect: "https://fallback.test",
+	}
+	if err := Redirect(resp, req, c); err != nil {
+		t.Errorf("Expected the disabled type to trigger fallback, got error: %s", err.Error())
+	}
+	if location := resp.Header().Get("Location"); location != c.Redirect {
+		t.Errorf("Expected fallback to redirect to %s, got %s", c.Redirect, location)
+	}
+}
+
+func TestRedirectUnknownType(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://unknown.host.example.com/", nil)
+	resp := httptest.NewRecorder()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host", "future"},
+		Redirect: "https://fallback.test",
+	}
+	if err := Redirect(resp, req, c); err != nil {
+		t.Errorf("Expected the unknown type to trigger fallback, got error: %s", err.Error())
+	}
+	if location := resp.Header().Get("Location"); location != c.Redirect {
+		t.Errorf("Expected fallback to redirect to %s, got %s", c.Redirect, location)
+	}
+}
+
+func TestRedirectEnablePerHost(t *testing.T) {
+	tests := []struct {
+		enablePerHost map[string][]string
+		fallback      bool
+	}{
+		{
+			enablePerHost: nil,
+			fallback:      true,
+		},
+		{
+			enablePerHost: map[string][]string{"pkg.gometa.gometa.example.com": {"gometa"}},
+			fallback:      false,
+		},
+		{
+			enablePerHost: map[string][]string{"other.gometa.example.com": {"gometa"}},
+			fallback:      true,
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://pkg.gometa.gometa.example.com/?go-get=1", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:      "127.0.0.1:" + strconv.Itoa(port),
+			Enable:        []string{"host"},
+			EnablePerHost: test.enablePerHost,
+			Redirect:      "https://fallback.test",
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		fellBack := resp.Header().Get("Location") == c.Redirect
+		if fellBack != test.fallback {
+			t.Errorf("Test %d: Expected fallback to be %t, got %t", i, test.fallback, fellBack)
+		}
+	}
+}
+
+func TestRedirectFamily(t *testing.T) {
+	tests := []struct {
+		host     string
+		location string
+	}{
+		{
+			host:     "v4only.host.example.com",
+			location: "https://fallback.test",
+		},
+		{
+			host:     "v6.host.example.com",
+			location: "https://[2001:db8::1]/",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+			Redirect: "https://fallback.test",
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func TestRedirectFlag(t *testing.T) {
+	tests := []struct {
+		evaluator func(flag string, r *http.Request) bool
+		location  string
+	}{
+		{
+			evaluator: func(flag string, r *http.Request) bool { return flag == "new-checkout" },
+			location:  "https://new-checkout.test",
+		},
+		{
+			evaluator: func(flag string, r *http.Request) bool { return false },
+			location:  "https://fallback.test",
+		},
+		{
+			evaluator: nil,
+			location:  "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://flag.host.example.com/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:      "127.0.0.1:" + strconv.Itoa(port),
+			Enable:        []string{"host"},
+			Redirect:      "https://fallback.test",
+			FlagEvaluator: test.evaluator,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func TestRedirectAlias(t *testing.T) {
+	tests := []struct {
+		host     string
+		location string
+	}{
+		{
+			host:     "alias.host.example.com",
+			location: "https://aliased.host.test",
+		},
+		{
+			host:     "loop1.host.example.com",
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host", "alias"},
+			Redirect: "https://fallback.test",
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func TestRedirectDebugHeaders(t *testing.T) {
+	tests := []struct {
+		debug bool
+		chain string
+	}{
+		{
+			debug: true,
+			chain: "_redirect.alias.host.example.com;type=alias, _redirect.aliased.host.example.com;type=host",
+		},
+		{
+			debug: false,
+			chain: "",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://alias.host.example.com/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+			Enable:       []string{"host", "alias"},
+			DebugHeaders: test.debug,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if chain := resp.Header().Get("X-TXTDirect-Chain"); chain != test.chain {
+			t.Errorf("Test %d: Expected X-TXTDirect-Chain to be %q, got %q", i, test.chain, chain)
+		}
+	}
+}
+
+func TestRedirectFromScheme(t *testing.T) {
+	tests := []struct {
+		url      string
+		proto    string
+		proxies  []string
+		location string
+	}{
+		{
+			url:      "https://tls.host.example.com/",
+			location: "https://tls.host.test",
+		},
+		{
+			url:      "http://tls.host.example.com/",
+			location: "https://fallback.test",
+		},
+		{
+			url:      "http://tls.host.example.com/",
+			proto:    "https",
+			proxies:  []string{"192.0.2.0/24"},
+			location: "https://tls.host.test",
+		},
+		{
+			url:      "http://tls.host.example.com/",
+			proto:    "https",
+			proxies:  []string{"192.0.2.1"},
+			location: "https://tls.host.test",
+		},
+		{
+			url:      "http://tls.host.example.com/",
+			proto:    "http",
+			proxies:  []string{"192.0.2.0/24"},
+			location: "https://fallback.test",
+		},
+		// X-Forwarded-Proto is ignored from the untrusted clients
+		{
+			url:      "http://tls.host.example.com/",
+			proto:    "https",
+			location: "https://fallback.test",
+		},
+		{
+			url:      "http://tls.host.example.com/",
+			proto:    "https",
+			proxies:  []string{"198.51.100.0/24"},
+			location: "https://fallback.test",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:       "127.0.0.1:" + strconv.Itoa(port),
+			Enable:         []string{"host"},
+			Redirect:       "https://fallback.test",
+			TrustedProxies: test.proxies,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+
+	if err := (Config{TrustedProxies: []string{"192.0.2.0/33"}}).Validate(); err == nil {
+		t.Errorf("Expected an error for an invalid trusted proxy")
+	}
+}
+
+func TestRedirectHours(t *testing.T) {
+	t.Cleanup(func() { now = time.Now })
+
+	tests := []struct {
+		host     string
+		now      time.Time
+		location string
+	}{
+		{
+			// 10:00 in New York
+			host:     "hours.host.example.com",
+			now:      time.Date(2020, 6, 1, 14, 0, 0, 0, time.UTC),
+			location: "https://support.test",
+		},
+		{
+			// 19:00 in New York
+			host:     "hours.host.example.com",
+			now:      time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC),
+			location: "https://afterhours.test",
+		},
+		{
+			// 08:59 in New York
+			host:     "hours.host.example.com",
+			now:      time.Date(2020, 6, 1, 12, 59, 0, 0, time.UTC),
+			location: "https://afterhours.test",
+		},
+		{
+			// 19:00 in New York
+			host:     "hours.weighted.host.example.com",
+			now:      time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC),
+			location: "http://afterhours.test/",
+		},
+	}
+	for i, test := range tests {
+		current := test.now
+		now = func() time.Time { return current }
+
+		req := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if location := resp.Header().Get("Location"); location != test.location {
+			t.Errorf("Test %d: Expected location to be %s, got %s", i, test.location, location)
+		}
+	}
+}
+
+func TestRedirectReferer(t *testing.T) {
+	tests := []struct {
+		referer string
+		code    int
+	}{
+		{
+			referer: "https://example.com/some/page",
+			code:    http.StatusFound,
+		},
+		{
+			referer: "https://blog.example.com/",
+			code:    http.StatusFound,
+		},
+		{
+			referer: "https://notexample.com/",
+			code:    http.StatusForbidden,
+		},
+		{
+			referer: "",
+			code:    http.StatusForbidden,
+		},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "https://referer.host.example.com/", nil)
+		if test.referer != "" {
+			req.Header.Set("Referer", test.referer)
+		}
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver: "127.0.0.1:" + strconv.Itoa(port),
+			Enable:   []string{"host"},
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Unexpected error occured: %s", err.Error())
+		}
+		if resp.Code != test.code {
+			t.Errorf("Expected status code %d for referer \"%s\", got %d", test.code, test.referer, resp.Code)
+		}
+	}
+}
+
+func TestRedirectServerTiming(t *testing.T) {
+	format := regexp.MustCompile(`^dns;dur=\d+\.\d{2}, parse;dur=\d+\.\d{2}$`)
+	for _, enabled := range []bool{true, false} {
+		req := httptest.NewRequest("GET", "https://host.host.example.com/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:     "127.0.0.1:" + strconv.Itoa(port),
+			Enable:       []string{"host"},
+			ServerTiming: enabled,
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Unexpected error occured: %s", err.Error())
+		}
+
+		header := resp.Header().Get("Server-Timing")
+		if enabled && !format.MatchString(header) {
+			t.Errorf("Expected a valid Server-Timing header, got \"%s\"", header)
+		}
+		if !enabled && header != "" {
+			t.Errorf("Expected no Server-Timing header, got \"%s\"", header)
+		}
+	}
+}
+
+func TestRedirectNonce(t *testing.T) {
+	const key = "secret"
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+		NonceKey: key,
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "https://nonce.host.example.com/", nil)
+		resp := httptest.NewRecorder()
+		if err := Redirect(resp, req, c); err != nil {
+			t.Fatalf("Unexpected error occured: %s", err.Error())
+		}
+
+		location, err := url.Parse(resp.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Couldn't parse the Location header: %s", err)
+		}
+		if location.Query().Get("id") != "1" {
+			t.Errorf("Expected the target's query to be kept, got %s", location.RawQuery)
+		}
+
+		parts := strings.Split(location.Query().Get("nonce"), ".")
+		if len(parts) != 2 {
+			t.Fatalf("Expected the nonce to be signed, got \"%s\"", location.Query().Get("nonce"))
+		}
+		mac := hmac.New(sha256.New, []byte(key))
+		mac.Write([]byte(parts[0]))
+		if parts[1] != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Expected a valid signature for nonce %s, got %s", parts[0], parts[1])
+		}
+		if seen[parts[0]] {
+			t.Errorf("Expected a unique nonce for each request, got %s twice", parts[0])
+		}
+		seen[parts[0]] = true
+	}
+}
+
+func TestRedirectOnRedirect(t *testing.T) {
+	var events []RedirectEvent
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+		OnRedirect: func(e RedirectEvent) {
+			events = append(events, e)
+		},
+	}
+	req := httptest.NewRequest("GET", "https://host.host.example.com/", nil)
+	resp := httptest.NewRecorder()
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error occured: %s", err.Error())
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected the callback to be called once, got %d", len(events))
+	}
+	expected := RedirectEvent{
+		Host:   "host.host.example.com",
+		Target: "https://plain.host.test",
+		Type:   "host",
+		Code:   http.StatusFound,
+	}
+	e := events[0]
+	if e.Host != expected.Host || e.Target != expected.Target || e.Type != expected.Type || e.Code != expected.Code {
+		t.Errorf("Expected event %+v, got %+v", expected, e)
+	}
+	if e.Duration <= 0 {
+		t.Errorf("Expected a positive duration, got %s", e.Duration)
+	}
+}
+
+func TestRedirectCacheControl(t *testing.T) {
+	addr := startDNSServer(t, "udp", func(w dns.ResponseWriter, r *dns.Msg) {
+		switch r.Question[0].Name {
+		case "_redirect.maxage.example.com.":
+			w.WriteMsg(txtReply(r, "v=txtv0;to=https://ttl.test;code=302;max-age=600"))
+		case "_redirect.permanent.example.com.":
+			w.WriteMsg(txtReply(r, "v=txtv0;to=https://ttl.test;code=308"))
+		case "_redirect.temporary.example.com.":
+			w.WriteMsg(txtReply(r, "v=txtv0;to=https://ttl.test;code=302"))
+		default:
+			w.WriteMsg(txtReply(r, "v=txtv0;to=https://ttl.test;code=301"))
+		}
+	})
+
+	tests := []struct {
+		host      string
+		dnsClient bool
+		expected  string
+	}{
+		{
+			host:      "ttl.example.com",
+			dnsClient: true,
+			expected:  "max-age=60",
+		},
+		{
+			// net.Resolver doesn't expose the TTL
+			host:      "ttl.example.com",
+			dnsClient: false,
+			expected:  fmt.Sprintf("max-age=%d", Status301CacheAge),
+		},
+		{
+			host:     "maxage.example.com",
+			expected: "max-age=600",
+		},
+		{
+			host:     "permanent.example.com",
+			expected: fmt.Sprintf("max-age=%d", Status301CacheAge),
+		},
+		{
+			host:     "temporary.example.com",
+			expected: "",
+		},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://"+test.host+"/", nil)
+		resp := httptest.NewRecorder()
+		c := Config{
+			Resolver:  addr,
+			DNSClient: test.dnsClient,
+			Enable:    []string{"host"},
+		}
+		if err := Redirect(resp, req, c); err != nil {
+			t.Errorf("Test %d: Unexpected error occured: %s", i, err.Error())
+		}
+		if cc := resp.Header().Get("Cache-Control"); cc != test.expected {
+			t.Errorf("Test %d: Expected Cache-Control to be %s, got %s", i, test.expected, cc)
+		}
+	}
+}
+
+func TestRedirectPreservesMethod(t *testing.T) {
+	req := httptest.NewRequest("POST", "https://api.host.example.com/", strings.NewReader("payload"))
+	resp := httptest.NewRecorder()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+	}
+	if err := Redirect(resp, req, c); err != nil {
+		t.Fatalf("Unexpected error occured: %s", err.Error())
+	}
+	// Clients repeat the request with the same method and body on a 307
+	if resp.Code != http.StatusTemporaryRedirect {
+		t.Errorf("Expected status code %d, got %d", http.StatusTemporaryRedirect, resp.Code)
+	}
+	if location := resp.Header().Get("Location"); location != "https://api.host.test/v2" {
+		t.Errorf("Expected location to be https://api.host.test/v2, got %s", location)
+	}
+}
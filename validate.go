@@ -0,0 +1,93 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// recordTypes are the record types that Redirect can serve
+var recordTypes = []string{"host", "path", "gometa", "alias"}
+
+// ValidationErrors contains every problem found in a TXT record
+type ValidationErrors []error
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidateRecord runs the same checks as ParseRecord on the given TXT
+// record without a request to serve. Instead of stopping at the first
+// problem it returns a ValidationErrors with all of them, or nil if
+// the record is valid.
+func ValidateRecord(str string, c Config) error {
+	// Placeholders are replaced with the values of an empty request
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		return err
+	}
+
+	s := splitFields(str)
+	if !isRecord(s) {
+		return ValidationErrors{fmt.Errorf("not a txtdirect record")}
+	}
+
+	r := Record{
+		Headers: map[string]string{},
+	}
+	var errs ValidationErrors
+	for _, l := range s {
+		if err := parseField(&r, l, req, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	errs = append(errs, r.missingFields()...)
+
+	if r.Scheme != "" && r.To != "" {
+		if _, err := setScheme(r.To, r.Scheme); err != nil {
+			errs = append(errs, fmt.Errorf("could not set the target's scheme: %s", err))
+		}
+	}
+
+	if len(r.Use) == 0 {
+		if r.Type == "" {
+			r.Type = "host"
+		}
+		if r.Type == "host" && r.To == "" {
+			errs = append(errs, ErrMissingTarget)
+		}
+		if !contains(recordTypes, r.Type) {
+			errs = append(errs, fmt.Errorf("unknown record type %s", r.Type))
+		} else if !contains(c.Enable, r.Type) {
+			errs = append(errs, fmt.Errorf("%s type is not enabled in configuration", r.Type))
+		}
+	}
+
+	if c.SchemaValidate {
+		if err := r.validateSchema(); err != nil {
+			errs = append(errs, err.(ValidationErrors)...)
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
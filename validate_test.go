@@ -0,0 +1,96 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		errs   []string
+	}{
+		{
+			record: "v=txtv0;to=https://example.com/;code=302",
+		},
+		{
+			record: "v=txtv0;type=path;re=record",
+		},
+		{
+			record: "v=txtv0;use=_redirect.example.com",
+		},
+		{
+			record: "to=https://example.com/;type=host",
+		},
+		{
+			record: "v=spf1 include:_spf.example.com ~all",
+			errs:   []string{"not a txtdirect record"},
+		},
+		{
+			record: "v=txtv0;code=200;max-age=-1",
+			errs: []string{
+				"unsupported status code 200",
+				"max-age should be a non-negative integer",
+				"to= field is required in host type",
+			},
+		},
+		{
+			record: "v=txtv0;to=https://example.com/;type=dockerv2",
+			errs:   []string{"unknown record type dockerv2"},
+		},
+		{
+			record: "v=txtv0;to=https://example.com/;type=gometa;vcs=git",
+			errs:   []string{"gometa type is not enabled in configuration"},
+		},
+		{
+			record: "v=txtv0;to=https://example.com/" + strings.Repeat("a", 255),
+			errs:   []string{"TXT record cannot exceed the maximum of 255 characters"},
+		},
+		{
+			record: "v=txtv0;to=https://example.com/;hours=09:00-17:00;corp=everyone",
+			errs: []string{
+				"unsupported corp value",
+				"hours= requires an afterhours.to= target",
+			},
+		},
+	}
+	c := Config{
+		Enable: []string{"host", "path"},
+	}
+	for i, test := range tests {
+		err := ValidateRecord(test.record, c)
+		if len(test.errs) == 0 {
+			if err != nil {
+				t.Errorf("Test %d: Unexpected error: %s", i, err)
+			}
+			continue
+		}
+		errs, ok := err.(ValidationErrors)
+		if !ok {
+			t.Errorf("Test %d: Expected ValidationErrors, got %v", i, err)
+			continue
+		}
+		if len(errs) != len(test.errs) {
+			t.Errorf("Test %d: Expected %d errors, got %d: %s", i, len(test.errs), len(errs), err)
+			continue
+		}
+		for j, expected := range test.errs {
+			if !strings.HasPrefix(errs[j].Error(), expected) {
+				t.Errorf("Test %d: Expected error %q, got %q", i, expected, errs[j])
+			}
+		}
+	}
+}
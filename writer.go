@@ -0,0 +1,83 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// hookWriter runs its hooks with the status code right before the
+// response headers get written. It's used to add the headers that are
+// only known once the request is resolved, like Server-Timing.
+type hookWriter struct {
+	http.ResponseWriter
+	hooks       []func(code int)
+	wroteHeader bool
+}
+
+// addHeaderHook adds the given hook to w if it's a hookWriter already
+// or wraps it with a new one, so the writers don't get stacked
+func addHeaderHook(w http.ResponseWriter, hook func(code int)) http.ResponseWriter {
+	hw, ok := w.(*hookWriter)
+	if !ok {
+		hw = &hookWriter{ResponseWriter: w}
+	}
+	hw.hooks = append(hw.hooks, hook)
+	return hw
+}
+
+// runHooks runs the hooks once, the latest added hook first. The
+// headers set by the nested Redirect calls are overridden by the
+// outer ones that way.
+func (w *hookWriter) runHooks(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	for i := len(w.hooks) - 1; i >= 0; i-- {
+		w.hooks[i](code)
+	}
+}
+
+func (w *hookWriter) WriteHeader(code int) {
+	w.runHooks(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *hookWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *hookWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// prepareHeader runs the header hooks of w if it has any. The hijacked
+// responses of redirectWithReason bypass WriteHeader, so they call it
+// right before writing the headers instead.
+func prepareHeader(w http.ResponseWriter, code int) {
+	if hw, ok := w.(*hookWriter); ok {
+		hw.runHooks(code)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txtdirect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_addHeaderHook(t *testing.T) {
+	resp := httptest.NewRecorder()
+	var codes []int
+	var w http.ResponseWriter = resp
+	w = addHeaderHook(w, func(code int) {
+		codes = append(codes, code)
+		w.Header().Set("X-Hook", "outer")
+	})
+	w = addHeaderHook(w, func(code int) {
+		codes = append(codes, code)
+		w.Header().Set("X-Hook", "nested")
+	})
+
+	hw, ok := w.(*hookWriter)
+	if !ok || hw.ResponseWriter != resp {
+		t.Fatalf("Expected the hooks to share a single writer, got %#v", w)
+	}
+
+	w.Write([]byte("body"))
+	w.WriteHeader(http.StatusFound)
+	if len(codes) != 2 || codes[0] != http.StatusOK || codes[1] != http.StatusOK {
+		t.Errorf("Expected both hooks to run once with the written status, got %v", codes)
+	}
+	if hook := resp.Header().Get("X-Hook"); hook != "outer" {
+		t.Errorf("Expected the first added hook to run last, got %s", hook)
+	}
+}